@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -84,37 +85,55 @@ func parseUserPasswd(userPasswd string) (user string, au *authUser, err error) {
 	return user, au, nil
 }
 
-func parseAllowedClient(val string) {
-	if val == "" {
-		return
-	}
+// parseNetAddrList parses comma separated list of ip/nbitmask given in
+// option.
+func parseNetAddrList(option, val string) []netAddr {
 	arr := strings.Split(val, ",")
-	auth.allowedClient = make([]netAddr, len(arr))
+	addrs := make([]netAddr, len(arr))
 	for i, v := range arr {
 		s := strings.TrimSpace(v)
 		ipAndMask := strings.Split(s, "/")
 		if len(ipAndMask) > 2 {
-			Fatal("allowedClient syntax error: client should be the form ip/nbitmask")
+			Fatal(option + " syntax error: client should be the form ip/nbitmask")
 		}
 		ip := net.ParseIP(ipAndMask[0])
 		if ip == nil {
-			Fatalf("allowedClient syntax error %s: ip address not valid\n", s)
+			Fatalf("%s syntax error %s: ip address not valid\n", option, s)
 		}
 		var mask net.IPMask
 		if len(ipAndMask) == 2 {
 			nbit, err := strconv.Atoi(ipAndMask[1])
 			if err != nil {
-				Fatalf("allowedClient syntax error %s: %v\n", s, err)
+				Fatalf("%s syntax error %s: %v\n", option, s, err)
 			}
 			if nbit > 32 {
-				Fatal("allowedClient error: mask number should <= 32")
+				Fatal(option + " error: mask number should <= 32")
 			}
 			mask = NewNbitIPv4Mask(nbit)
 		} else {
 			mask = NewNbitIPv4Mask(32)
 		}
-		auth.allowedClient[i] = netAddr{ip.Mask(mask), mask}
+		addrs[i] = netAddr{ip.Mask(mask), mask}
+	}
+	return addrs
+}
+
+// matchNetAddr checks whether ip matches one in addrs. It uses a sequential
+// search.
+func matchNetAddr(addrs []netAddr, ip net.IP) bool {
+	for _, na := range addrs {
+		if ip.Mask(na.mask).Equal(na.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAllowedClient(val string) {
+	if val == "" {
+		return
 	}
+	auth.allowedClient = parseNetAddrList("allowedClient", val)
 }
 
 func addUserPasswd(val string) {
@@ -195,19 +214,26 @@ func Authenticate(conn *clientConn, r *Request) (err error) {
 	return
 }
 
+// clientCertAuthed returns true if https proxy client has sent certificate
+// signed by tlsClientCAFile.
+func (c *clientConn) clientCertAuthed() bool {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	return len(tc.ConnectionState().VerifiedChains) > 0
+}
+
 // authIP checks whether the client ip address matches one in allowedClient.
-// It uses a sequential search.
 func authIP(clientIP string) bool {
 	ip := net.ParseIP(clientIP)
 	if ip == nil {
 		panic("authIP should always get IP address")
 	}
 
-	for _, na := range auth.allowedClient {
-		if ip.Mask(na.mask).Equal(na.ip) {
-			debug.Printf("client ip %s allowed\n", clientIP)
-			return true
-		}
+	if matchNetAddr(auth.allowedClient, ip) {
+		debug.Printf("client ip %s allowed\n", clientIP)
+		return true
 	}
 	return false
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"path"
 	"reflect"
@@ -27,6 +29,8 @@ const (
 	loadBalanceBackup LoadBalanceMode = iota
 	loadBalanceHash
 	loadBalanceLatency
+	loadBalanceWeighted
+	loadBalanceLeastConn
 )
 
 // allow the same tunnel ports as polipo
@@ -55,19 +59,54 @@ type Config struct {
 	AllowedClient  string
 	AuthTimeout    time.Duration
 
+	// https proxy
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string // client certificate signed by this CA is authenticated
+
 	// advanced options
 	DialTimeout time.Duration
 	ReadTimeout time.Duration
+	RaceDelay   time.Duration // start parent connection this long after direct, 0 to disable
+
+	// built-in resolver
+	DNSServer       string          // query with UDP, empty to use system resolver
+	DNSParentServer string          // query with TCP through parent proxy for blocked sites
+	DNSPoisonIP     map[string]bool // IPs in poisoned answer
+
+	// aging of learned site stat
+	StatHalfLife    time.Duration // half life of visit count, 0 to disable decay
+	TempBlockedTTL  time.Duration
+	DirectSiteTTL   time.Duration // remove learned direct site not visited this long
+	BlockedSiteTTL  time.Duration
+	ReprobeInterval time.Duration // probe learned blocked sites directly, 0 to disable
+
+	// share learned site stat with other cow instances
+	ShareStat        bool     // serve learned stat at /stat
+	StatPeer         []string // URL of peer cow to pull stat from
+	StatPeerInterval time.Duration
+
+	// clients receiving X-Cow-Route header explaining routing decision
+	RouteHeaderClient []netAddr
+
+	// parent proxy health check
+	HealthCheckInterval time.Duration
+	HealthCheckTarget   string
 
 	Core         int
 	DetectSSLErr bool
 
 	HttpErrorCode int
 
-	dir         string // directory containing config file
-	StatFile    string // Path for stat file
-	BlockedFile string // blocked sites specified by user
-	DirectFile  string // direct sites specified by user
+	dir          string // directory containing config file
+	StatFile     string // Path for stat file
+	BlockedFile  string // blocked sites specified by user
+	DirectFile   string // direct sites specified by user
+	RouteFile    string // route rules specified by user
+	GFWListFile  string // blocked list in AutoProxy format
+	DirectIPFile string // IP ranges visited directly
+
+	PacTemplateFile string // user supplied PAC template
 
 	// not configurable in config file
 	PrintVer        bool
@@ -90,6 +129,9 @@ func initConfig(rcFile string) {
 	config.BlockedFile = path.Join(config.dir, blockedFname)
 	config.DirectFile = path.Join(config.dir, directFname)
 	config.StatFile = path.Join(config.dir, statFname)
+	config.RouteFile = path.Join(config.dir, routeFname)
+	config.GFWListFile = path.Join(config.dir, gfwlistFname)
+	config.DirectIPFile = path.Join(config.dir, directIPFname)
 
 	config.DetectSSLErr = false
 	config.AlwaysProxy = false
@@ -98,6 +140,16 @@ func initConfig(rcFile string) {
 	config.DialTimeout = defaultDialTimeout
 	config.ReadTimeout = defaultReadTimeout
 
+	// Health check is disabled by default, parent proxy is marked down by
+	// failures of user requests.
+	config.HealthCheckInterval = 0
+	config.HealthCheckTarget = defaultHealthCheckTarget
+
+	config.TempBlockedTTL = defaultTempBlockedTTL
+	config.StatPeerInterval = defaultStatPeerInterval
+	config.DirectSiteTTL = siteStaleThreshold
+	config.BlockedSiteTTL = siteStaleThreshold
+
 	config.TunnelAllowedPort = make(map[string]bool)
 	for _, port := range defaultTunnelAllowedPort {
 		config.TunnelAllowedPort[port] = true
@@ -185,13 +237,36 @@ func isUserPasswdValid(val string) bool {
 type proxyParser struct{}
 
 func (p proxyParser) ProxySocks5(val string) {
-	if err := checkServerAddr(val); err != nil {
+	var userPasswd, server string
+
+	// Password may contain @, use the right-most one to separate server.
+	if idx := strings.LastIndex(val, "@"); idx == -1 {
+		server = val
+	} else {
+		userPasswd = val[:idx]
+		server = val[idx+1:]
+	}
+
+	if err := checkServerAddr(server); err != nil {
 		Fatal("parent socks server", err)
 	}
-	parentProxy.add(newSocksParent(val))
+	parent := newSocksParent(server)
+	if userPasswd != "" {
+		if !isUserPasswdValid(userPasswd) {
+			Fatal("socks parent proxy user password syntax wrong, should be in the form of user:passwd")
+		}
+		up := strings.SplitN(userPasswd, ":", 2)
+		// rfc 1929 uses 1 byte for length
+		if len(up[0]) > 255 || len(up[1]) > 255 {
+			Fatal("socks parent proxy username and password should be at most 255 bytes")
+		}
+		parent.initAuth(up[0], up[1])
+	}
+	parentProxy.add(parent)
 }
 
-func (pp proxyParser) ProxyHttp(val string) {
+// Parse [user:passwd@]server:port
+func parseHttpParent(val string) *httpParent {
 	var userPasswd, server string
 
 	arr := strings.Split(val, "@")
@@ -212,10 +287,83 @@ func (pp proxyParser) ProxyHttp(val string) {
 
 	parent := newHttpParent(server)
 	parent.initAuth(userPasswd)
+	return parent
+}
+
+func (pp proxyParser) ProxyHttp(val string) {
+	parentProxy.add(parseHttpParent(val))
+}
+
+// Parse [user:passwd@]server:port [sni=name] [ca=file] [skipVerify=true]
+func (pp proxyParser) ProxyHttps(val string) {
+	arr := strings.Fields(val)
+	if len(arr) == 0 {
+		Fatal("https parent proxy has no server address")
+	}
+	parent := parseHttpParent(arr[0])
+
+	var serverName, caFile string
+	var skipVerify bool
+	for _, opt := range arr[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			Fatal("https parent proxy option should be key=value:", opt)
+		}
+		switch kv[0] {
+		case "sni":
+			serverName = kv[1]
+		case "ca":
+			caFile = expandTilde(kv[1])
+			if err := isFileExists(caFile); err != nil {
+				Fatal("https parent proxy ca:", err)
+			}
+		case "skipVerify":
+			skipVerify = parseBool(kv[1], "https parent proxy skipVerify")
+		default:
+			Fatal("unknown https parent proxy option:", opt)
+		}
+	}
+	if err := parent.initTLS(serverName, caFile, skipVerify); err != nil {
+		Fatal("https parent proxy", err)
+	}
+	parent.tlsOpts = strings.Join(arr[1:], " ")
 	parentProxy.add(parent)
 }
 
-// Parse method:passwd@server:port
+// Parse the user info and host part of SIP002 URI:
+// base64(method:passwd)@server:port[/][?plugin=...][#tag]
+func parseSIP002(userInfo, hostPart string) (methodPasswd, server string, err error) {
+	// SIP002 requires URL safe base64 without padding, but also accept
+	// standard encoding used by some clients.
+	userInfo = strings.TrimRight(userInfo, "=")
+	b, err := base64.RawURLEncoding.DecodeString(userInfo)
+	if err != nil {
+		if b, err = base64.RawStdEncoding.DecodeString(userInfo); err != nil {
+			err = errors.New("method and password should be separated by : or base64 encoded")
+			return
+		}
+	}
+	methodPasswd = string(b)
+
+	if idx := strings.Index(hostPart, "#"); idx != -1 {
+		hostPart = hostPart[:idx]
+	}
+	if idx := strings.Index(hostPart, "?"); idx != -1 {
+		var query url.Values
+		if query, err = url.ParseQuery(hostPart[idx+1:]); err != nil {
+			return
+		}
+		if query.Get("plugin") != "" {
+			err = errors.New("SIP003 plugin not supported")
+			return
+		}
+		hostPart = hostPart[:idx]
+	}
+	server = strings.TrimSuffix(hostPart, "/")
+	return
+}
+
+// Parse method:passwd@server:port, or SIP002 URI without the scheme.
 func parseMethodPasswdServer(val string) (method, passwd, server string, err error) {
 	// Use the right-most @ symbol to seperate method:passwd and server:port.
 	idx := strings.LastIndex(val, "@")
@@ -226,6 +374,11 @@ func parseMethodPasswdServer(val string) (method, passwd, server string, err err
 
 	methodPasswd := val[:idx]
 	server = val[idx+1:]
+	if !strings.Contains(methodPasswd, ":") {
+		if methodPasswd, server, err = parseSIP002(methodPasswd, server); err != nil {
+			return
+		}
+	}
 	if err = checkServerAddr(server); err != nil {
 		return
 	}
@@ -252,8 +405,13 @@ func (pp proxyParser) ProxySs(val string) {
 	parentProxy.add(parent)
 }
 
+// Parse method:passwd@server:port [mux=n]
 func (pp proxyParser) ProxyCow(val string) {
-	method, passwd, server, err := parseMethodPasswdServer(val)
+	arr := strings.Fields(val)
+	if len(arr) == 0 {
+		Fatal("cow parent proxy has no server address")
+	}
+	method, passwd, server, err := parseMethodPasswdServer(arr[0])
 	if err != nil {
 		Fatal("cow parent", err)
 	}
@@ -264,6 +422,65 @@ func (pp proxyParser) ProxyCow(val string) {
 
 	config.saveReqLine = true
 	parent := newCowParent(server, method, passwd)
+	for _, opt := range arr[1:] {
+		if !strings.HasPrefix(opt, "mux=") {
+			Fatal("unknown cow parent proxy option:", opt)
+		}
+		n, err := strconv.Atoi(opt[len("mux="):])
+		if err != nil || n < 1 {
+			Fatal("cow parent proxy mux should be positive integer:", opt)
+		}
+		parent.initMux(n)
+	}
+	parentProxy.add(parent)
+}
+
+// Parse user[:passwd]@server[:port][?key=file&knownHosts=file]
+func (pp proxyParser) ProxySsh(val string) {
+	var options string
+	if id := strings.Index(val, "?"); id != -1 {
+		options = val[id+1:]
+		val = val[:id]
+	}
+	id := strings.LastIndex(val, "@")
+	if id == -1 {
+		Fatal("ssh parent proxy requires user name:", val)
+	}
+	userPasswd, server := val[:id], val[id+1:]
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "22")
+	}
+	var user, passwd string
+	arr := strings.SplitN(userPasswd, ":", 2)
+	user = arr[0]
+	if len(arr) == 2 {
+		passwd = arr[1]
+	}
+	if user == "" {
+		Fatal("ssh parent proxy requires user name:", val)
+	}
+
+	query, err := url.ParseQuery(options)
+	if err != nil {
+		Fatal("ssh parent proxy options", err)
+	}
+	var keyFile, knownHostsFile string
+	for k, v := range query {
+		switch k {
+		case "key":
+			keyFile = expandTilde(v[0])
+		case "knownHosts":
+			knownHostsFile = expandTilde(v[0])
+		default:
+			Fatal("unknown ssh parent proxy option:", k)
+		}
+	}
+
+	parent := newSshParent(server, user)
+	if err := parent.initAuth(passwd, keyFile, knownHostsFile); err != nil {
+		Fatal("ssh parent proxy", err)
+	}
+	parent.options = options
 	parentProxy.add(parent)
 }
 
@@ -291,6 +508,27 @@ func (lp listenParser) ListenHttp(val string) {
 	addListenProxy(newHttpProxy(addr, addrInPAC))
 }
 
+func (lp listenParser) ListenHttps(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	arr := strings.Fields(val)
+	if len(arr) > 2 {
+		Fatal("too many fields in listen = https://", val)
+	}
+
+	var addr, addrInPAC string
+	addr = arr[0]
+	if len(arr) == 2 {
+		addrInPAC = arr[1]
+	}
+
+	if err := checkServerAddr(addr); err != nil {
+		Fatal("listen https server", err)
+	}
+	addListenProxy(newHttpsProxy(addr, addrInPAC))
+}
+
 func (lp listenParser) ListenCow(val string) {
 	if cmdHasListenAddr {
 		return
@@ -302,13 +540,73 @@ func (lp listenParser) ListenCow(val string) {
 	addListenProxy(newCowProxy(method, passwd, addr))
 }
 
+func (lp listenParser) ListenSocks5(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	if err := checkServerAddr(val); err != nil {
+		Fatal("listen socks5 server", err)
+	}
+	addListenProxy(newSocksProxy(val))
+}
+
+func (lp listenParser) ListenRedir(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	if !redirSupported {
+		Fatal("listen redir: transparent proxy only supported on Linux")
+	}
+	if err := checkServerAddr(val); err != nil {
+		Fatal("listen redir server", err)
+	}
+	addListenProxy(newRedirProxy(val))
+}
+
 // configParser provides functions to parse options in config file.
 type configParser struct{}
 
+// Remove options applying to all types of parent proxy from proxy config:
+// weight=n and group=name1,name2
+func parseProxyOptions(val string) (rest string, weight int, group []string) {
+	weight = 1
+	arr := strings.Fields(val)
+	if len(arr) < 2 {
+		return val, weight, nil
+	}
+	opts := arr[:1]
+	found := false
+	for _, opt := range arr[1:] {
+		switch {
+		case strings.HasPrefix(opt, "weight="):
+			var err error
+			if weight, err = strconv.Atoi(opt[len("weight="):]); err != nil || weight < 1 {
+				Fatal("parent proxy weight should be positive integer:", opt)
+			}
+		case strings.HasPrefix(opt, "group="):
+			for _, name := range strings.Split(opt[len("group="):], ",") {
+				if name == "" || name == routeDirect || name == routeReject {
+					Fatal("invalid parent proxy group name:", opt)
+				}
+				group = append(group, name)
+			}
+		default:
+			opts = append(opts, opt)
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return val, weight, nil
+	}
+	return strings.Join(opts, " "), weight, group
+}
+
 func (p configParser) ParseProxy(val string) {
 	parser := reflect.ValueOf(proxyParser{})
 	zeroMethod := reflect.Value{}
 
+	val, weight, group := parseProxyOptions(val)
 	arr := strings.Split(val, "://")
 	if len(arr) != 2 {
 		Fatal("proxy has no protocol specified:", val)
@@ -320,8 +618,17 @@ func (p configParser) ParseProxy(val string) {
 	if method == zeroMethod {
 		Fatalf("no such protocol \"%s\"\n", arr[0])
 	}
+	backPool, ok := parentProxy.(*backupParentPool)
+	if !ok {
+		panic("initial parent pool should be backup pool")
+	}
+	nparent := len(backPool.parent)
 	args := []reflect.Value{reflect.ValueOf(arr[1])}
 	method.Call(args)
+	for i := nparent; i < len(backPool.parent); i++ {
+		backPool.parent[i].weight = weight
+		backPool.parent[i].group = group
+	}
 }
 
 func (p configParser) ParseListen(val string) {
@@ -452,6 +759,10 @@ func (p configParser) ParseLoadBalance(val string) {
 		config.LoadBalance = loadBalanceHash
 	case "latency":
 		config.LoadBalance = loadBalanceLatency
+	case "weighted":
+		config.LoadBalance = loadBalanceWeighted
+	case "leastconn":
+		config.LoadBalance = loadBalanceLeastConn
 	default:
 		Fatalf("invalid loadBalance mode: %s\n", val)
 	}
@@ -475,6 +786,66 @@ func (p configParser) ParseDirectFile(val string) {
 	}
 }
 
+func (p configParser) ParseRouteFile(val string) {
+	config.RouteFile = expandTilde(val)
+	if err := isFileExists(config.RouteFile); err != nil {
+		Fatal("route file:", err)
+	}
+}
+
+func (p configParser) ParseGfwlistFile(val string) {
+	config.GFWListFile = expandTilde(val)
+	if err := isFileExists(config.GFWListFile); err != nil {
+		Fatal("gfwlist file:", err)
+	}
+}
+
+func parseDNSServer(val, msg string) string {
+	if _, _, err := net.SplitHostPort(val); err != nil {
+		val = net.JoinHostPort(val, "53")
+	}
+	host, _, _ := net.SplitHostPort(val)
+	if net.ParseIP(host) == nil {
+		Fatalf("%s should be IP address: %s\n", msg, val)
+	}
+	return val
+}
+
+func (p configParser) ParseDnsServer(val string) {
+	config.DNSServer = parseDNSServer(val, "dnsServer")
+}
+
+func (p configParser) ParseDnsParentServer(val string) {
+	config.DNSParentServer = parseDNSServer(val, "dnsParentServer")
+}
+
+func (p configParser) ParseDnsPoisonIP(val string) {
+	if config.DNSPoisonIP == nil {
+		config.DNSPoisonIP = make(map[string]bool)
+	}
+	for _, s := range strings.Split(val, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			Fatalf("invalid IP in dnsPoisonIP: %s\n", s)
+		}
+		config.DNSPoisonIP[ip.String()] = true
+	}
+}
+
+func (p configParser) ParsePacTemplateFile(val string) {
+	config.PacTemplateFile = expandTilde(val)
+	if err := isFileExists(config.PacTemplateFile); err != nil {
+		Fatal("PAC template file:", err)
+	}
+}
+
+func (p configParser) ParseDirectIPFile(val string) {
+	config.DirectIPFile = expandTilde(val)
+	if err := isFileExists(config.DirectIPFile); err != nil {
+		Fatal("direct IP file:", err)
+	}
+}
+
 var shadow struct {
 	parent *shadowsocksParent
 	passwd string
@@ -567,6 +938,27 @@ func (p configParser) ParseAuthTimeout(val string) {
 	config.AuthTimeout = parseDuration(val, "authTimeout")
 }
 
+func (p configParser) ParseTlsCertFile(val string) {
+	config.TLSCertFile = expandTilde(val)
+	if err := isFileExists(config.TLSCertFile); err != nil {
+		Fatal("tlsCertFile:", err)
+	}
+}
+
+func (p configParser) ParseTlsKeyFile(val string) {
+	config.TLSKeyFile = expandTilde(val)
+	if err := isFileExists(config.TLSKeyFile); err != nil {
+		Fatal("tlsKeyFile:", err)
+	}
+}
+
+func (p configParser) ParseTlsClientCAFile(val string) {
+	config.TLSClientCAFile = expandTilde(val)
+	if err := isFileExists(config.TLSClientCAFile); err != nil {
+		Fatal("tlsClientCAFile:", err)
+	}
+}
+
 func (p configParser) ParseCore(val string) {
 	config.Core = parseInt(val, "core")
 }
@@ -583,6 +975,80 @@ func (p configParser) ParseDialTimeout(val string) {
 	config.DialTimeout = parseDuration(val, "dialTimeout")
 }
 
+func (p configParser) ParseRaceDelay(val string) {
+	config.RaceDelay = parseDuration(val, "raceDelay")
+	if config.RaceDelay < 0 {
+		Fatal("raceDelay should not be negative")
+	}
+}
+
+func parsePositiveDuration(val, msg string) time.Duration {
+	d := parseDuration(val, msg)
+	if d <= 0 {
+		Fatal(msg, "should be positive")
+	}
+	return d
+}
+
+func parseNonNegativeDuration(val, msg string) time.Duration {
+	d := parseDuration(val, msg)
+	if d < 0 {
+		Fatal(msg, "should not be negative")
+	}
+	return d
+}
+
+func (p configParser) ParseStatHalfLife(val string) {
+	config.StatHalfLife = parseNonNegativeDuration(val, "statHalfLife")
+}
+
+func (p configParser) ParseTempBlockedTTL(val string) {
+	config.TempBlockedTTL = parsePositiveDuration(val, "tempBlockedTTL")
+}
+
+func (p configParser) ParseDirectSiteTTL(val string) {
+	config.DirectSiteTTL = parsePositiveDuration(val, "directSiteTTL")
+}
+
+func (p configParser) ParseBlockedSiteTTL(val string) {
+	config.BlockedSiteTTL = parsePositiveDuration(val, "blockedSiteTTL")
+}
+
+func (p configParser) ParseReprobeInterval(val string) {
+	config.ReprobeInterval = parseNonNegativeDuration(val, "reprobeInterval")
+}
+
+func (p configParser) ParseShareStat(val string) {
+	config.ShareStat = parseBool(val, "shareStat")
+}
+
+func (p configParser) ParseStatPeer(val string) {
+	if !strings.HasPrefix(val, "http://") && !strings.HasPrefix(val, "https://") {
+		Fatal("statPeer should be http or https URL:", val)
+	}
+	config.StatPeer = append(config.StatPeer, val)
+}
+
+func (p configParser) ParseStatPeerInterval(val string) {
+	config.StatPeerInterval = parsePositiveDuration(val, "statPeerInterval")
+}
+
+func (p configParser) ParseRouteHeaderClient(val string) {
+	config.RouteHeaderClient = append(config.RouteHeaderClient,
+		parseNetAddrList("routeHeaderClient", val)...)
+}
+
+func (p configParser) ParseHealthCheckInterval(val string) {
+	config.HealthCheckInterval = parseDuration(val, "healthCheckInterval")
+}
+
+func (p configParser) ParseHealthCheckTarget(val string) {
+	if err := checkServerAddr(val); err != nil {
+		Fatal("healthCheckTarget", err)
+	}
+	config.HealthCheckTarget = val
+}
+
 func (p configParser) ParseDetectSSLErr(val string) {
 	config.DetectSSLErr = parseBool(val, "detectSSLErr")
 }
@@ -746,4 +1212,5 @@ func checkConfig() {
 	if listenProxy == nil {
 		listenProxy = []Proxy{newHttpProxy(defaultListenAddr, "")}
 	}
+	initListenTLS()
 }
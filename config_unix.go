@@ -1,3 +1,4 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
 // +build darwin freebsd linux netbsd openbsd
 
 package main
@@ -7,10 +8,13 @@ import (
 )
 
 const (
-	rcFname      = "rc"
-	blockedFname = "blocked"
-	directFname  = "direct"
-	statFname    = "stat"
+	rcFname       = "rc"
+	blockedFname  = "blocked"
+	directFname   = "direct"
+	statFname     = "stat"
+	routeFname    = "route"
+	gfwlistFname  = "gfwlist"
+	directIPFname = "direct_ip"
 
 	newLine = "\n"
 )
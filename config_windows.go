@@ -6,10 +6,13 @@ import (
 )
 
 const (
-	rcFname      = "rc.txt"
-	blockedFname = "blocked.txt"
-	directFname  = "direct.txt"
-	statFname    = "stat.txt"
+	rcFname       = "rc.txt"
+	blockedFname  = "blocked.txt"
+	directFname   = "direct.txt"
+	statFname     = "stat.txt"
+	routeFname    = "route.txt"
+	gfwlistFname  = "gfwlist.txt"
+	directIPFname = "direct_ip.txt"
 
 	newLine = "\r\n"
 )
@@ -90,11 +90,14 @@ func (cp *ConnPool) Get(hostPort string, asDirect bool) (sv *serverConn) {
 }
 
 func (cp *ConnPool) Put(sv *serverConn) {
-	// Multiplexing connections.
+	// Multiplexing connections. Routed connections are only for the same
+	// site, as other sites may use different parent proxy.
 	switch sv.Conn.(type) {
 	case httpConn, cowConn:
-		putConnToChan(sv, cp.muxConn, "muxConn")
-		return
+		if !sv.routed {
+			putConnToChan(sv, cp.muxConn, "muxConn")
+			return
+		}
 	}
 
 	// Site specific connections.
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Hosts resolved into IP ranges in direct IP file, e.g. all IP ranges of
+// the country, are visited directly.
+
+type ipv4Range struct {
+	start, end uint32
+}
+
+// ipRangeList stores IPv4 ranges sorted and merged, so lookup can use binary
+// search. IPv6 networks are rare in such lists and checked one by one.
+type ipRangeList struct {
+	v4 []ipv4Range
+	v6 []*net.IPNet
+}
+
+func ipv4ToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip)
+}
+
+// add parses CIDR or IP address and adds it to the list. Call sort
+// after adding all ranges.
+func (l *ipRangeList) add(s string) error {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP range %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	ip4 := ipNet.IP.To4()
+	if ip4 == nil || len(ipNet.Mask) != net.IPv4len {
+		l.v6 = append(l.v6, ipNet)
+		return nil
+	}
+	start := ipv4ToUint(ip4)
+	end := start | ^ipv4ToUint(net.IP(ipNet.Mask))
+	l.v4 = append(l.v4, ipv4Range{start, end})
+	return nil
+}
+
+// sort sorts IPv4 ranges and merges overlapping or adjacent ones.
+func (l *ipRangeList) sort() {
+	if len(l.v4) == 0 {
+		return
+	}
+	sort.Slice(l.v4, func(i, j int) bool { return l.v4[i].start < l.v4[j].start })
+	merged := l.v4[:1]
+	for _, r := range l.v4[1:] {
+		last := &merged[len(merged)-1]
+		if last.end == ^uint32(0) || r.start <= last.end+1 {
+			if r.end > last.end {
+				last.end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	l.v4 = merged
+}
+
+func (l *ipRangeList) empty() bool {
+	return len(l.v4) == 0 && len(l.v6) == 0
+}
+
+func (l *ipRangeList) contains(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		n := ipv4ToUint(ip4)
+		i := sort.Search(len(l.v4), func(i int) bool { return l.v4[i].end >= n })
+		return i < len(l.v4) && l.v4[i].start <= n
+	}
+	for _, ipNet := range l.v6 {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pacRanges returns IPv4 ranges as JavaScript array elements.
+func (l *ipRangeList) pacRanges() string {
+	lst := make([]string, len(l.v4))
+	for i, r := range l.v4 {
+		lst[i] = fmt.Sprintf("[%d,%d]", r.start, r.end)
+	}
+	return strings.Join(lst, ",\n")
+}
+
+func loadDirectIPFile(fpath string) (l *ipRangeList, err error) {
+	l = &ipRangeList{}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		if err = l.add(s); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	l.sort()
+	return l, nil
+}
+
+var directIP = &ipRangeList{}
+
+func initDirectIP() {
+	if err := isFileExists(config.DirectIPFile); err != nil {
+		if !os.IsNotExist(err) {
+			Fatal("direct IP file:", err)
+		}
+		return
+	}
+	l, err := loadDirectIPFile(config.DirectIPFile)
+	if err != nil {
+		Fatal("direct IP file:", err)
+	}
+	directIP = l
+	debug.Printf("loaded %d IPv4 and %d IPv6 direct ranges\n", len(l.v4), len(l.v6))
+}
+
+// inDirectIP returns whether host resolves into direct IP ranges. Host is
+// resolved only if there's direct IP ranges.
+func inDirectIP(host string) bool {
+	if directIP.empty() {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return directIP.contains(ip)
+	}
+	ips, err := resolver.lookup(host, false)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	// Use the first address, which is what direct connection uses.
+	return directIP.contains(ips[0])
+}
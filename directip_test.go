@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIPRangeList(t *testing.T) {
+	var l ipRangeList
+	for _, s := range []string{"10.0.0.0/8", "1.0.1.0/24", "1.0.2.0/23", "1.0.8.8", "1.0.2.0/24", "2001:db8::/32"} {
+		if err := l.add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.sort()
+	// 1.0.1.0/24 and 1.0.2.0/23 are adjacent, 1.0.2.0/24 is covered.
+	if len(l.v4) != 3 || len(l.v6) != 1 {
+		t.Fatalf("should have 3 IPv4 and 1 IPv6 ranges after merge, got %v %v\n", l.v4, l.v6)
+	}
+	if rs := l.pacRanges(); rs != "[16777472,16778239],\n[16779272,16779272],\n[167772160,184549375]" {
+		t.Error("wrong PAC ranges:", rs)
+	}
+
+	testData := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"1.0.1.0", true},
+		{"1.0.3.255", true},
+		{"1.0.4.0", false},
+		{"1.0.8.8", true},
+		{"1.0.8.9", false},
+		{"0.0.0.1", false},
+		{"255.255.255.255", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, td := range testData {
+		if l.contains(net.ParseIP(td.ip)) != td.contains {
+			t.Errorf("%s contains should be %v\n", td.ip, td.contains)
+		}
+	}
+
+	if err := l.add("1.2.3"); err == nil {
+		t.Error("invalid range should return error")
+	}
+}
+
+func TestDirectIPVisitCnt(t *testing.T) {
+	defer setRaceParent(&fakeParent{server: "127.0.0.1:1"})()
+	tmpDir, err := ioutil.TempDir("", "cow-directip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fpath := path.Join(tmpDir, "direct_ip")
+	if err := ioutil.WriteFile(fpath, []byte("# comment\n\n1.0.1.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadDirectIPFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := directIP
+	defer func() { directIP = saved }()
+	directIP = l
+
+	ss := newSiteStat()
+	url, _ := ParseRequestURI("1.0.1.1")
+	if vc := ss.GetVisitCnt(url); !vc.AsDirect() || vc.userSpecified() {
+		t.Error("host in direct IP range should be learned as direct")
+	} else if vc.BlockedVisit(); vc.AsDirect() {
+		t.Error("host in direct IP range should be blocked after blocked visit")
+	}
+	url, _ = ParseRequestURI("1.0.2.1")
+	if ss.GetVisitCnt(url).userSpecified() {
+		t.Error("host not in direct IP range should not be user specified")
+	}
+
+	ioutil.WriteFile(fpath, []byte("1.0.1.0/24\nfoo\n"), 0644)
+	if _, err := loadDirectIPFile(fpath); err == nil {
+		t.Error("invalid direct IP file should return error")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in resolver for direct connections. Answers are cached according to
+// TTL. GFW poisons DNS by replying with bogus IPs, answers containing IP in
+// config.DNSPoisonIP are considered poisoned. For hosts considered blocked,
+// DNS server can be queried with DNS over TCP through parent proxy, which
+// avoids poisoning.
+//
+// Only A records are queried from DNS server, system resolver is used if
+// DNS server is not specified or there's no A record.
+
+const (
+	dnsTimeout = 5 * time.Second
+	// TTL for answers from system resolver, which does not return TTL.
+	dnsDefaultTTL = time.Minute
+	dnsMinTTL     = 10 * time.Second
+	dnsMaxTTL     = time.Hour
+	// Max number of cached hosts. When full, expired entries are removed,
+	// and random entries are evicted if cache is still more than
+	// dnsCacheEvictSize. So cache is not scanned on every put.
+	dnsCacheSize      = 4096
+	dnsCacheEvictSize = dnsCacheSize * 3 / 4
+
+	dnsTypeA     = 1
+	dnsClassIN   = 1
+	dnsHeaderLen = 12
+)
+
+var errDNSPoisoned = errors.New("poisoned DNS answer")
+
+type dnsError struct {
+	host string
+	msg  string
+}
+
+func (e *dnsError) Error() string {
+	return "dns lookup " + e.host + ": " + e.msg
+}
+
+type dnsCacheEntry struct {
+	ips       []net.IP
+	expire    time.Time
+	viaParent bool
+}
+
+type dnsResolver struct {
+	sync.RWMutex
+	cache map[string]*dnsCacheEntry
+}
+
+var resolver = &dnsResolver{cache: make(map[string]*dnsCacheEntry)}
+
+// packDNSQuery creates query for A record of host.
+func packDNSQuery(id uint16, host string) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(host)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // question count
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, &dnsError{host, "invalid domain name"}
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, dnsTypeA, 0, dnsClassIN)
+	return msg, nil
+}
+
+// skipDNSName returns offset after the domain name starting at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xC0 == 0xC0: // compression pointer
+			return off + 2, nil
+		}
+		off += n + 1
+	}
+	return 0, errors.New("dns message too short")
+}
+
+// unpackDNSReply returns IPs in A records and the minimum TTL of them.
+func unpackDNSReply(msg []byte, id uint16, host string) (ips []net.IP, ttl time.Duration, err error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg) != id {
+		return nil, 0, &dnsError{host, "invalid reply"}
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, 0, &dnsError{host, "not a reply"}
+	}
+	if rcode := flags & 0xF; rcode != 0 {
+		return nil, 0, &dnsError{host, fmt.Sprintf("server returned rcode %d", rcode)}
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4 // type and class
+	}
+	var minTTL uint32
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, &dnsError{host, "reply too short"}
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rrTTL := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, &dnsError{host, "reply too short"}
+		}
+		// CNAME is followed by A records of the canonical name.
+		if rrType == dnsTypeA && rdlen == net.IPv4len {
+			ips = append(ips, net.IPv4(msg[off], msg[off+1], msg[off+2], msg[off+3]))
+			if len(ips) == 1 || rrTTL < minTTL {
+				minTTL = rrTTL
+			}
+		}
+		off += rdlen
+	}
+	return ips, time.Duration(minTTL) * time.Second, nil
+}
+
+func isDNSPoisoned(ips []net.IP) bool {
+	for _, ip := range ips {
+		if config.DNSPoisonIP[ip.String()] {
+			return true
+		}
+	}
+	return false
+}
+
+// queryDNS sends query through c and returns the reply. Length prefix is
+// used for TCP.
+func queryDNS(c net.Conn, query []byte, tcp bool) ([]byte, error) {
+	c.SetDeadline(time.Now().Add(dnsTimeout))
+	if tcp {
+		b := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(b, uint16(len(query)))
+		query = append(b, query...)
+	}
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	if !tcp {
+		buf := make([]byte, 1500)
+		n, err := c.Read(buf)
+		return buf[:n], err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	_, err := io.ReadFull(c, buf)
+	return buf, err
+}
+
+// dialDNSParent connects to DNS server with TCP through parent proxy.
+func dialDNSParent(server string) (net.Conn, error) {
+	url := &URL{}
+	url.ParseHostPort(server)
+	c, err := parentProxy.connect(url)
+	if err != nil {
+		return nil, err
+	}
+	if err = parentTunnel(c, server); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// exchange queries DNS server for host. Returns nil IPs if there's no A
+// record.
+func (r *dnsResolver) exchange(host string, viaParent bool) (ips []net.IP, ttl time.Duration, err error) {
+	id := uint16(rand.Intn(1 << 16))
+	query, err := packDNSQuery(id, host)
+	if err != nil {
+		return
+	}
+	var c net.Conn
+	if viaParent {
+		c, err = dialDNSParent(config.DNSParentServer)
+	} else {
+		c, err = net.DialTimeout("udp", config.DNSServer, dnsTimeout)
+	}
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	reply, err := queryDNS(c, query, viaParent)
+	if err != nil {
+		return
+	}
+	return unpackDNSReply(reply, id, host)
+}
+
+func (r *dnsResolver) get(host string, viaParent bool) []net.IP {
+	r.RLock()
+	e := r.cache[host]
+	r.RUnlock()
+	if e == nil || time.Now().After(e.expire) || (viaParent && !e.viaParent) {
+		return nil
+	}
+	return e.ips
+}
+
+func (r *dnsResolver) put(host string, ips []net.IP, ttl time.Duration, viaParent bool) {
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	} else if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	now := time.Now()
+	r.Lock()
+	if _, ok := r.cache[host]; !ok && len(r.cache) >= dnsCacheSize {
+		for h, e := range r.cache {
+			if now.After(e.expire) {
+				delete(r.cache, h)
+			}
+		}
+		// Map iteration order is random.
+		for h := range r.cache {
+			if len(r.cache) <= dnsCacheEvictSize {
+				break
+			}
+			delete(r.cache, h)
+		}
+	}
+	r.cache[host] = &dnsCacheEntry{ips, now.Add(ttl), viaParent}
+	r.Unlock()
+}
+
+// lookup resolves host, using cached answer if not expired. If viaParent is
+// true, query config.DNSParentServer through parent proxy. Returns
+// errDNSPoisoned if answer contains poisoned IP.
+func (r *dnsResolver) lookup(host string, viaParent bool) ([]net.IP, error) {
+	if ips := r.get(host, viaParent); ips != nil {
+		return ips, nil
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if viaParent || config.DNSServer != "" {
+		// Fallback to system resolver on error.
+		if ips, ttl, err = r.exchange(host, viaParent); err != nil {
+			debug.Printf("dns lookup %s (via parent: %v): %v\n", host, viaParent, err)
+		}
+	}
+	if len(ips) == 0 {
+		viaParent = false
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+		ttl = dnsDefaultTTL
+	}
+	if isDNSPoisoned(ips) {
+		debug.Printf("dns lookup %s got poisoned answer %v\n", host, ips)
+		return nil, errDNSPoisoned
+	}
+	r.put(host, ips, ttl, viaParent)
+	return ips, nil
+}
+
+// dialResolved connects to url with IP returned by resolver, trying each
+// address in turn. Timeout 0 means no timeout.
+func dialResolved(url *URL, siteInfo *VisitCnt, timeout time.Duration) (net.Conn, error) {
+	if net.ParseIP(url.Host) != nil {
+		return net.DialTimeout("tcp", url.HostPort, timeout)
+	}
+	viaParent := config.DNSParentServer != "" && siteInfo.mostlyBlocked() && !parentProxy.empty()
+	ips, err := resolver.lookup(url.Host, viaParent)
+	if err == errDNSPoisoned && !siteInfo.userSpecified() && siteStat.get(url.Host) != nil {
+		siteStat.TempBlocked(url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Timeout is for all IPs, remaining time is split among IPs not tried
+	// yet, as done by net.Dialer.
+	deadline := time.Now().Add(timeout)
+	for i, ip := range ips {
+		to := timeout
+		if timeout > 0 {
+			if to = deadline.Sub(time.Now()) / time.Duration(len(ips)-i); to <= 0 {
+				if err == nil {
+					err = fmt.Errorf("dial %s timeout", url.HostPort)
+				}
+				break
+			}
+		}
+		var c net.Conn
+		if c, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), url.Port), to); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsTestReply creates reply to query with a CNAME record followed by A
+// records.
+func dnsTestReply(query []byte, ttl uint32, ips ...string) []byte {
+	msg := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(msg[2:], 0x8180)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(ips)+1))
+	rr := func(typ uint16, rdata []byte) {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint16(b, 0xC00C) // pointer to question name
+		binary.BigEndian.PutUint16(b[2:], typ)
+		binary.BigEndian.PutUint16(b[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(b[6:], ttl)
+		binary.BigEndian.PutUint16(b[10:], uint16(len(rdata)))
+		msg = append(append(msg, b...), rdata...)
+	}
+	rr(5, []byte{3, 'w', 'w', 'w', 0xC0, 0x0C}) // CNAME
+	for _, ip := range ips {
+		rr(dnsTypeA, net.ParseIP(ip).To4())
+	}
+	return msg
+}
+
+func TestDNSPackUnpack(t *testing.T) {
+	query, err := packDNSQuery(0x1234, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query) != 12+13+4 || query[12] != 7 || query[20] != 3 {
+		t.Errorf("wrong query %v\n", query)
+	}
+	reply := dnsTestReply(query, 300, "1.2.3.4", "5.6.7.8")
+	ips, ttl, err := unpackDNSReply(reply, 0x1234, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || ips[0].String() != "1.2.3.4" || ips[1].String() != "5.6.7.8" || ttl != 300*time.Second {
+		t.Errorf("wrong answer %v %v\n", ips, ttl)
+	}
+
+	if _, _, err = unpackDNSReply(reply, 0x4321, "example.com"); err == nil {
+		t.Error("reply with wrong id should return error")
+	}
+	if _, _, err = unpackDNSReply(reply[:len(reply)-2], 0x1234, "example.com"); err == nil {
+		t.Error("truncated reply should return error")
+	}
+	binary.BigEndian.PutUint16(reply[2:], 0x8183) // NXDOMAIN
+	if _, _, err = unpackDNSReply(reply, 0x1234, "example.com"); err == nil {
+		t.Error("error rcode should return error")
+	}
+	if _, err = packDNSQuery(1, "a..com"); err == nil {
+		t.Error("invalid domain should return error")
+	}
+}
+
+func setTestResolver() func() {
+	savedResolver := resolver
+	savedServer, savedParentServer, savedPoison := config.DNSServer, config.DNSParentServer, config.DNSPoisonIP
+	resolver = &dnsResolver{cache: make(map[string]*dnsCacheEntry)}
+	return func() {
+		resolver = savedResolver
+		config.DNSServer, config.DNSParentServer, config.DNSPoisonIP = savedServer, savedParentServer, savedPoison
+	}
+}
+
+func TestDNSResolverUDP(t *testing.T) {
+	defer setTestResolver()()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var nquery int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&nquery, 1)
+			ip := "127.0.0.1"
+			if buf[13] == 'p' { // poisoned.com
+				ip = "10.1.1.1"
+			}
+			pc.WriteTo(dnsTestReply(buf[:n], 1, ip), addr)
+		}
+	}()
+	config.DNSServer = pc.LocalAddr().String()
+	config.DNSPoisonIP = map[string]bool{"10.1.1.1": true}
+
+	for i := 0; i < 2; i++ {
+		ips, err := resolver.lookup("example.com", false)
+		if err != nil || len(ips) != 1 || ips[0].String() != "127.0.0.1" {
+			t.Fatalf("lookup got %v %v\n", ips, err)
+		}
+	}
+	if n := atomic.LoadInt32(&nquery); n != 1 {
+		t.Errorf("answer should be cached, got %d queries\n", n)
+	}
+	// TTL less than minimum is raised.
+	if e := resolver.cache["example.com"]; e.expire.Before(time.Now().Add(dnsMinTTL - time.Second)) {
+		t.Error("cache expire time should respect minimum TTL")
+	}
+	resolver.cache["example.com"].expire = time.Now().Add(-time.Second)
+	resolver.lookup("example.com", false)
+	if n := atomic.LoadInt32(&nquery); n != 2 {
+		t.Errorf("expired answer should be queried again, got %d queries\n", n)
+	}
+
+	defer setRaceParent(&fakeParent{server: "127.0.0.1:1"})()
+	saved := siteStat
+	defer func() { siteStat = saved }()
+	siteStat = newSiteStat()
+	url, _ := ParseRequestURI("poisoned.com:80")
+	vc := siteStat.GetVisitCnt(url)
+	if _, err := dialResolved(url, vc, time.Second); err != errDNSPoisoned {
+		t.Fatal("poisoned answer should return error, got", err)
+	}
+	if !vc.AsTempBlocked() {
+		t.Error("host with poisoned answer should be temp blocked")
+	}
+	if resolver.get("poisoned.com", false) != nil {
+		t.Error("poisoned answer should not be cached")
+	}
+}
+
+func TestDNSResolverViaParent(t *testing.T) {
+	defer setTestResolver()()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	var nquery int32
+	defer setRaceParent(&pipeParent{func(c net.Conn) {
+		defer c.Close()
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		atomic.AddInt32(&nquery, 1)
+		reply := dnsTestReply(query, 600, "127.0.0.1")
+		binary.BigEndian.PutUint16(lenBuf[:], uint16(len(reply)))
+		c.Write(append(lenBuf[:], reply...))
+	}})()
+	config.DNSParentServer = "8.8.8.8:53"
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	url, _ := ParseRequestURI("blocked.com:" + port)
+	c, err := dialResolved(url, newVisitCnt(0, 10), time.Second)
+	if err != nil {
+		t.Fatal("dial with answer from parent should succeed:", err)
+	}
+	c.Close()
+	if atomic.LoadInt32(&nquery) != 1 {
+		t.Fatal("blocked host should be resolved through parent")
+	}
+	if e := resolver.cache["blocked.com"]; e == nil || !e.viaParent {
+		t.Error("answer from parent should be cached")
+	}
+	if resolver.get("blocked.com", true) == nil {
+		t.Error("cached answer from parent should be used for blocked host")
+	}
+}
+
+func TestDNSCacheEvict(t *testing.T) {
+	r := &dnsResolver{cache: make(map[string]*dnsCacheEntry)}
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	for i := 0; i < dnsCacheSize; i++ {
+		r.put(fmt.Sprintf("host%d.com", i), ips, time.Minute, false)
+	}
+	if len(r.cache) != dnsCacheSize {
+		t.Fatal("cache should not evict before full, got", len(r.cache))
+	}
+	r.put("new.com", ips, time.Minute, false)
+	if len(r.cache) != dnsCacheEvictSize+1 || r.get("new.com", false) == nil {
+		t.Error("should evict entries when cache is full, got", len(r.cache))
+	}
+}
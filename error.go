@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
 	"text/template"
@@ -87,6 +88,23 @@ func sendPageGeneric(w io.Writer, codeReason, h1, msg string) {
 	w.Write(buf.Bytes())
 }
 
+// sendTextPage sends plain text, used for status pages of COW itself.
+func sendTextPage(w io.Writer, text string) {
+	fmt.Fprintf(w, "HTTP/1.1 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: %d\r\n\r\n%s", len(text), text)
+}
+
 func sendErrorPage(w io.Writer, codeReason, h1, msg string) {
+	if c, ok := w.(*clientConn); ok && !c.isHTTPClient() {
+		// SOCKS client can't understand error page, reply error code instead.
+		// Transparent proxy client gets nothing, connection will be closed.
+		if c.isSocks() {
+			c.sendSocksError(codeReason)
+		}
+		return
+	}
 	sendPageGeneric(w, codeReason, "[Error] "+h1, msg)
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// GFWList uses AutoProxy format, which is a subset of Adblock Plus filter
+// syntax. The list is usually base64 encoded. COW only cares about hosts, so
+// the following rules are converted to domains, others are ignored:
+//
+//   ||example.com      example.com and all its sub domains
+//   |http://example.com/path
+//   .example.com       keyword rule, path part is ignored
+//   @@||example.com    exception, domain is considered as direct
+//
+// Regular expression rules match against URL, so they are ignored.
+
+// Check whether GFWList file is modified this often.
+const gfwlistCheckInterval = time.Minute
+
+type gfwList struct {
+	blocked map[string]bool
+	direct  map[string]bool
+}
+
+// gfwlistDomain extracts domain from rule, returns empty string if rule is
+// not about domain.
+func gfwlistDomain(rule string) string {
+	if len(rule) > 1 && rule[0] == '/' && rule[len(rule)-1] == '/' {
+		return ""
+	}
+	rule = strings.TrimLeft(rule, "|")
+	for _, scheme := range []string{"http://", "https://"} {
+		rule = strings.TrimPrefix(rule, scheme)
+	}
+	rule = strings.TrimPrefix(rule, "*.")
+	rule = strings.TrimLeft(rule, ".")
+	if i := strings.IndexAny(rule, "/^:$"); i != -1 {
+		rule = rule[:i]
+	}
+	rule = strings.ToLower(strings.TrimSuffix(rule, "."))
+	if rule == "" || strings.ContainsAny(rule, "*%?=") || !strings.Contains(rule, ".") {
+		return ""
+	}
+	return rule
+}
+
+// decodeGFWList returns the decoded content if data is base64 encoded.
+// Plain list can't be base64 decoded as it contains "|" or ".".
+func decodeGFWList(data []byte) []byte {
+	b64 := bytes.Join(bytes.Fields(data), nil)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(b64)))
+	n, err := base64.StdEncoding.Decode(decoded, b64)
+	if err != nil {
+		return data
+	}
+	return decoded[:n]
+}
+
+func parseGFWList(data []byte) *gfwList {
+	gl := &gfwList{
+		blocked: make(map[string]bool),
+		direct:  make(map[string]bool),
+	}
+	data = decodeGFWList(data)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		m := gl.blocked
+		if strings.HasPrefix(line, "@@") {
+			m = gl.direct
+			line = line[2:]
+		}
+		if domain := gfwlistDomain(line); domain != "" {
+			m[domain] = true
+		}
+	}
+	return gl
+}
+
+func matchDomainSet(set map[string]bool, host string) bool {
+	if net.ParseIP(host) != nil {
+		return set[host]
+	}
+	for h := host; ; {
+		if set[h] {
+			return true
+		}
+		i := strings.IndexByte(h, '.')
+		if i == -1 {
+			return false
+		}
+		h = h[i+1:]
+	}
+}
+
+// match returns visit count for host matching the list, nil if not
+// matched. Exceptions take precedence as in Adblock Plus.
+func (gl *gfwList) match(host string) *VisitCnt {
+	host = strings.ToLower(host)
+	if matchDomainSet(gl.direct, host) {
+		return alwaysDirectVisitCnt
+	}
+	if matchDomainSet(gl.blocked, host) {
+		return alwaysBlockedVisitCnt
+	}
+	return nil
+}
+
+// matchGFWList returns visit count for host according to GFWList, nil if
+// not matched.
+func (ss *SiteStat) matchGFWList(host string) *VisitCnt {
+	ss.gfwLock.RLock()
+	gl := ss.gfwlist
+	ss.gfwLock.RUnlock()
+	if gl == nil {
+		return nil
+	}
+	return gl.match(host)
+}
+
+// loadGFWList loads GFWList file if it's modified since last load. Returns
+// whether the list is changed.
+func (ss *SiteStat) loadGFWList(fpath string) bool {
+	if fpath == "" {
+		return false
+	}
+	stat, err := os.Stat(fpath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			errl.Println("Error loading GFWList:", err)
+		}
+		return false
+	}
+	ss.gfwLock.RLock()
+	modTime := ss.gfwlistMod
+	ss.gfwLock.RUnlock()
+	if stat.ModTime().Equal(modTime) {
+		return false
+	}
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		errl.Println("Error loading GFWList:", err)
+		return false
+	}
+	gl := parseGFWList(data)
+	ss.gfwLock.Lock()
+	ss.gfwlist = gl
+	ss.gfwlistMod = stat.ModTime()
+	ss.gfwLock.Unlock()
+	debug.Printf("loaded GFWList %s, %d blocked, %d direct\n", fpath, len(gl.blocked), len(gl.direct))
+	return true
+}
+
+// reloadGFWList checks GFWList file for modification and reloads it, so we
+// can update the list without restarting cow.
+func reloadGFWList() {
+	for {
+		time.Sleep(gfwlistCheckInterval)
+		ss := siteStat
+		if ss.loadGFWList(config.GFWListFile) {
+			ss.filterSites()
+			info.Println("GFWList reloaded")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const testGFWList = `[AutoProxy 0.2.9]
+! Comment
+||blocked.com
+|http://www.example.com/path
+|https://secure.example.net:8443/
+.keyword.org/path
+*.wild.com^
+@@||allowed.blocked.com
+/^https?:\/\/[^\/]+regexp\.com/
+||bad*.com
+`
+
+func TestParseGFWList(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(testGFWList))
+	// Lines in GFWList are usually wrapped.
+	for _, data := range []string{testGFWList, encoded[:64] + "\n" + encoded[64:]} {
+		gl := parseGFWList([]byte(data))
+		if len(gl.blocked) != 5 || len(gl.direct) != 1 {
+			t.Errorf("should have 5 blocked and 1 direct domain, got %v %v\n", gl.blocked, gl.direct)
+		}
+
+		testData := []struct {
+			host string
+			vc   *VisitCnt
+		}{
+			{"blocked.com", alwaysBlockedVisitCnt},
+			{"www.Blocked.com", alwaysBlockedVisitCnt},
+			{"allowed.blocked.com", alwaysDirectVisitCnt},
+			{"a.allowed.blocked.com", alwaysDirectVisitCnt},
+			{"www.example.com", alwaysBlockedVisitCnt},
+			{"example.com", nil},
+			{"secure.example.net", alwaysBlockedVisitCnt},
+			{"keyword.org", alwaysBlockedVisitCnt},
+			{"img.wild.com", alwaysBlockedVisitCnt},
+			{"regexp.com", nil},
+			{"notblocked.com", nil},
+		}
+		for _, td := range testData {
+			if vc := gl.match(td.host); vc != td.vc {
+				t.Errorf("%s match got %v, should be %v\n", td.host, vc, td.vc)
+			}
+		}
+	}
+}
+
+func TestSiteStatGFWList(t *testing.T) {
+	defer setRaceParent(&fakeParent{server: "127.0.0.1:1"})()
+	tmpDir, err := ioutil.TempDir("", "cow-gfwlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fpath := path.Join(tmpDir, "gfwlist")
+	if err := ioutil.WriteFile(fpath, []byte("||blocked.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := newSiteStat()
+	ss.loadList([]string{"direct.blocked.com"}, userCnt, 0)
+	ss.Vcnt["www.blocked.com"] = newVisitCnt(3, 0) // learned
+	if !ss.loadGFWList(fpath) {
+		t.Fatal("GFWList should be loaded")
+	}
+	if ss.loadGFWList(fpath) {
+		t.Error("GFWList should not be reloaded if not modified")
+	}
+	ss.filterSites()
+	if ss.get("www.blocked.com") != nil {
+		t.Error("learned site in GFWList should be filtered")
+	}
+
+	getVisitCnt := func(host string) *VisitCnt {
+		url, _ := ParseRequestURI(host)
+		return ss.GetVisitCnt(url)
+	}
+	if !getVisitCnt("www.blocked.com").AlwaysBlocked() {
+		t.Error("site in GFWList should be always blocked")
+	}
+	if !getVisitCnt("direct.blocked.com").AlwaysDirect() {
+		t.Error("user specified site should override GFWList")
+	}
+	if getVisitCnt("other.com").userSpecified() {
+		t.Error("site not in GFWList should not be user specified")
+	}
+
+	if err := ioutil.WriteFile(fpath, []byte("||other.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(fpath, modTime, modTime)
+	if !ss.loadGFWList(fpath) {
+		t.Fatal("modified GFWList should be reloaded")
+	}
+	if ss.matchGFWList("www.blocked.com") != nil || ss.matchGFWList("other.com") == nil {
+		t.Error("reloaded GFWList should replace the old one")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Circuit breaker state of parent proxy.
+type circuitState int
+
+const (
+	circuitClosed   circuitState = iota // parent is up
+	circuitOpen                         // parent is down, skipped by parent pools
+	circuitHalfOpen                     // a single trial connection is in progress
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "up"
+	case circuitOpen:
+		return "down"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	// Number of consecutive failures to mark a parent proxy down.
+	circuitFailThreshold = 3
+	// A down parent proxy is given a trial connection after this period.
+	circuitOpenTimeout = 30 * time.Second
+)
+
+// Target connected through parent proxy by health check and latency probe.
+// Use port 443 as most parent proxies allow CONNECT to it.
+const defaultHealthCheckTarget = "example.com:443"
+
+var errAllParentDown = errors.New("all parent proxies are down")
+
+// targetError is returned by parent proxy for error on the target, e.g.
+// target refused connection. Parent proxy is working in that case.
+type targetError struct {
+	error
+}
+
+// parentHealth tracks whether a parent proxy is usable. It's shared by all
+// parent pools containing the same parent proxy.
+type parentHealth struct {
+	server string
+
+	sync.Mutex
+	state    circuitState
+	fail     int // consecutive failure count
+	openTime time.Time
+}
+
+func newParentHealth(server string) *parentHealth {
+	return &parentHealth{server: server}
+}
+
+// allow returns whether the parent proxy can be used now. After
+// circuitOpenTimeout, a down parent proxy is allowed for exactly one caller,
+// which must report the result by calling success or failure.
+func (h *parentHealth) allow() bool {
+	h.Lock()
+	defer h.Unlock()
+	switch h.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Now().Sub(h.openTime) >= circuitOpenTimeout {
+			debug.Printf("parent proxy %s half-open, trying it\n", h.server)
+			h.state = circuitHalfOpen
+			return true
+		}
+	}
+	return false
+}
+
+// usable is the same as allow, except it does not start trial for down
+// parent proxy. Used when selecting among parent proxies.
+func (h *parentHealth) usable() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.state == circuitClosed ||
+		(h.state == circuitOpen && time.Now().Sub(h.openTime) >= circuitOpenTimeout)
+}
+
+func (h *parentHealth) success() {
+	h.Lock()
+	if h.state != circuitClosed {
+		info.Printf("parent proxy %s is up\n", h.server)
+	}
+	h.state = circuitClosed
+	h.fail = 0
+	h.Unlock()
+}
+
+func (h *parentHealth) failure(err error) {
+	h.Lock()
+	h.fail++
+	switch h.state {
+	case circuitClosed:
+		if h.fail < circuitFailThreshold {
+			break
+		}
+		errl.Printf("parent proxy %s is down: %v\n", h.server, err)
+		fallthrough
+	case circuitHalfOpen:
+		h.state = circuitOpen
+		h.openTime = time.Now()
+	}
+	h.Unlock()
+}
+
+// abort ends trial of half-open parent proxy without result, so the parent
+// can be tried again.
+func (h *parentHealth) abort() {
+	h.Lock()
+	if h.state == circuitHalfOpen {
+		h.state = circuitOpen
+	}
+	h.Unlock()
+}
+
+func (h *parentHealth) getState() circuitState {
+	h.Lock()
+	defer h.Unlock()
+	return h.state
+}
+
+func (h *parentHealth) getOpenTime() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.openTime
+}
+
+// lastResortParent returns index of the parent proxy which is down for the
+// longest time. When all parent proxies are down, trying one of them is
+// better than failing the request, as it may have recovered.
+func lastResortParent(n int, health func(i int) *parentHealth) int {
+	id := 0
+	for i := 1; i < n; i++ {
+		if health(i).getOpenTime().Before(health(id).getOpenTime()) {
+			id = i
+		}
+	}
+	return id
+}
+
+// connectParent connects through parent and updates its health. Only error
+// connecting to the parent proxy itself is counted as failure.
+func connectParent(parent ParentProxy, health *parentHealth, url *URL) (net.Conn, error) {
+	srvconn, err := parent.connect(url)
+	if te, ok := err.(targetError); ok {
+		health.success()
+		return nil, te.error
+	}
+	if err != nil {
+		// Don't blame parent proxy if our own network is bad.
+		if networkBad() {
+			health.abort()
+		} else {
+			health.failure(err)
+		}
+		return nil, err
+	}
+	health.success()
+	return srvconn, nil
+}
+
+// probeParent checks TCP connectivity to parent proxy, then creates a
+// connection to target through it. Shadowsocks protocol has no reply for
+// connection creation, so only the first check is reliable for it.
+func probeParent(parent ParentProxy, target string) error {
+	c, err := net.DialTimeout("tcp", parent.getServer(), dialTimeout)
+	if err != nil {
+		return err
+	}
+	c.Close()
+
+	url := &URL{}
+	url.ParseHostPort(target)
+	if c, err = parent.connect(url); err != nil {
+		return err
+	}
+	defer c.Close()
+	return parentTunnel(c, target)
+}
+
+// parentTunnel creates tunnel to target on connection returned by parent
+// proxy. http and cow parent forward requests from client, so connect only
+// creates connection to the parent.
+func parentTunnel(srvconn net.Conn, target string) error {
+	switch pc := srvconn.(type) {
+	case httpConn:
+		return httpConnectTunnel(pc, target, pc.parent.authHeader)
+	case cowConn:
+		return httpConnectTunnel(pc, target, nil)
+	}
+	return nil
+}
+
+// httpConnectTunnel creates tunnel to target through http or cow parent
+// proxy connection c.
+func httpConnectTunnel(c net.Conn, target string, authHeader []byte) error {
+	c.SetDeadline(time.Now().Add(dialTimeout + readTimeout))
+	defer c.SetDeadline(zeroTime)
+	req := []byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + CRLF)
+	req = append(req, authHeader...)
+	req = append(req, CRLF...)
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	// Read byte by byte to avoid consuming data after response header.
+	var rep []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(rep, []byte(CRLF+CRLF)) {
+		if len(rep) >= httpBufSize {
+			return fmt.Errorf("CONNECT %s response header too large", target)
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		rep = append(rep, b[0])
+	}
+	// Only need to check status code in status line "HTTP/1.1 200 ...".
+	if len(rep) < 12 || string(rep[9:12]) != "200" {
+		if i := bytes.IndexByte(rep, '\r'); i != -1 {
+			rep = rep[:i]
+		}
+		return fmt.Errorf("CONNECT %s got response %q", target, rep)
+	}
+	return nil
+}
+
+func (parent *ParentWithFail) healthCheck(wg *sync.WaitGroup) {
+	defer wg.Done()
+	health := parent.health
+	if !health.allow() {
+		return
+	}
+	if err := probeParent(parent.ParentProxy, config.HealthCheckTarget); err != nil {
+		debug.Printf("health check parent proxy %s: %v\n", health.server, err)
+		if networkBad() {
+			health.abort()
+		} else {
+			health.failure(err)
+		}
+		return
+	}
+	health.success()
+}
+
+// runHealthCheck probes all parent proxies periodically, so that a dead
+// parent proxy is marked down before user requests go through it.
+func runHealthCheck(parent []ParentWithFail) {
+	for {
+		var wg sync.WaitGroup
+		wg.Add(len(parent))
+		for i := range parent {
+			go parent[i].healthCheck(&wg)
+		}
+		wg.Wait()
+		time.Sleep(config.HealthCheckInterval)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeParent fails connect if fail is true and counts connect calls.
+type fakeParent struct {
+	server string
+	fail   bool
+	cnt    int
+}
+
+func (fp *fakeParent) connect(url *URL) (net.Conn, error) {
+	fp.cnt++
+	if fp.fail {
+		return nil, errors.New("fake parent fail")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (fp *fakeParent) getServer() string {
+	return fp.server
+}
+
+func (fp *fakeParent) genConfig() string {
+	return ""
+}
+
+func TestParentHealthCircuit(t *testing.T) {
+	h := newParentHealth("127.0.0.1:1")
+	err := errors.New("fail")
+	for i := 0; i < circuitFailThreshold-1; i++ {
+		h.failure(err)
+	}
+	if h.getState() != circuitClosed || !h.allow() {
+		t.Fatal("parent should be up before reaching fail threshold")
+	}
+	h.failure(err)
+	if h.getState() != circuitOpen || h.allow() {
+		t.Fatal("parent should be down after reaching fail threshold")
+	}
+
+	h.openTime = time.Now().Add(-circuitOpenTimeout)
+	if !h.allow() {
+		t.Fatal("down parent should be allowed for trial after open timeout")
+	}
+	if h.getState() != circuitHalfOpen || h.allow() {
+		t.Fatal("only one trial should be allowed for half-open parent")
+	}
+	h.failure(err)
+	if h.getState() != circuitOpen || h.allow() {
+		t.Fatal("failed trial should mark parent down again")
+	}
+
+	h.openTime = time.Now().Add(-circuitOpenTimeout)
+	h.allow()
+	h.success()
+	if h.getState() != circuitClosed || !h.allow() {
+		t.Fatal("successful trial should mark parent up")
+	}
+}
+
+func TestConnectInOrderSkipDown(t *testing.T) {
+	initConfig("")
+	bad := &fakeParent{server: "127.0.0.1:1", fail: true}
+	good := &fakeParent{server: "127.0.0.1:2"}
+	var pool backupParentPool
+	pool.add(bad)
+	pool.add(good)
+
+	url := &URL{HostPort: "example.com:80"}
+	for i := 0; i < 10; i++ {
+		c, err := pool.connect(url)
+		if err != nil {
+			t.Fatal("connect should succeed through good parent:", err)
+		}
+		c.Close()
+	}
+	if bad.cnt != circuitFailThreshold {
+		t.Errorf("down parent should not be tried, tried %d times\n", bad.cnt)
+	}
+	if good.cnt != 10 {
+		t.Errorf("good parent should be used for all connections, used %d times\n", good.cnt)
+	}
+
+	good.fail = true
+	for i := 0; i < circuitFailThreshold; i++ {
+		pool.connect(url)
+	}
+	// Parent down for the longest time is tried as last resort.
+	bad.fail = false
+	c, err := pool.connect(url)
+	if err != nil {
+		t.Fatal("recovered parent should be tried when all parents are down:", err)
+	}
+	c.Close()
+	if bad.cnt != circuitFailThreshold+1 || pool.parent[0].health.getState() != circuitClosed {
+		t.Error("successful last resort parent should be marked up")
+	}
+}
+
+func TestConnectParentTargetError(t *testing.T) {
+	initConfig("")
+	h := newParentHealth("127.0.0.1:1")
+	refused := errors.New("connection refused by target")
+	parent := &targetErrParent{targetError{refused}}
+	for i := 0; i < circuitFailThreshold*2; i++ {
+		if _, err := connectParent(parent, h, &URL{HostPort: "example.com:80"}); err != refused {
+			t.Fatal("target error should be returned unwrapped, got:", err)
+		}
+	}
+	if h.getState() != circuitClosed {
+		t.Error("target error should not mark parent down")
+	}
+}
+
+type targetErrParent struct {
+	err error
+}
+
+func (p *targetErrParent) connect(url *URL) (net.Conn, error) {
+	return nil, p.err
+}
+
+func (p *targetErrParent) getServer() string {
+	return "127.0.0.1:1"
+}
+
+func (p *targetErrParent) genConfig() string {
+	return ""
+}
+
+func TestProbeParent(t *testing.T) {
+	initConfig("")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Reply 200 for CONNECT to example.com:443, 403 for others.
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 512)
+				n, _ := c.Read(buf)
+				if n == 0 {
+					return
+				}
+				if strings.HasPrefix(string(buf[:n]), "CONNECT example.com:443 ") {
+					c.Write(connEstablished)
+				} else {
+					io.WriteString(c, "HTTP/1.1 403 Forbidden\r\n\r\n")
+				}
+			}(c)
+		}
+	}()
+
+	hp := newHttpParent(ln.Addr().String())
+	if err := probeParent(hp, "example.com:443"); err != nil {
+		t.Error("probe http parent should succeed, got:", err)
+	}
+	if err := probeParent(hp, "example.com:25"); err == nil {
+		t.Error("probe http parent should fail if CONNECT is rejected")
+	}
+
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln2.Addr().String()
+	ln2.Close()
+	if err := probeParent(newHttpParent(addr), "example.com:443"); err == nil {
+		t.Error("probe should fail if parent is not listening")
+	}
+}
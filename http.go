@@ -14,13 +14,13 @@ import (
 const CRLF = "\r\n"
 
 const (
-	statusCodeContinue = 100
+	statusCodeContinue           = 100
+	statusCodeSwitchingProtocols = 101
 )
 
 const (
 	statusBadReq         = "400 Bad Request"
 	statusForbidden      = "403 Forbidden"
-	statusExpectFailed   = "417 Expectation Failed"
 	statusRequestTimeout = "408 Request Timeout"
 )
 
@@ -35,14 +35,21 @@ type Header struct {
 	ConnectionKeepAlive bool
 	ExpectContinue      bool
 	Host                string
+	// Connection header value, only set if it contains "upgrade".
+	ConnectionUpgrade string
+	Upgrade           string
+	// Only used for requests to cow itself, e.g. PAC.
+	IfNoneMatch string
+	AcceptGzip  bool
 }
 
 type rqState byte
 
 const (
-	rsCreated  rqState = iota
-	rsSent             // request has been sent to server
-	rsRecvBody         // response header received, receiving response body
+	rsCreated      rqState = iota
+	rsWaitContinue         // request header sent, waiting for 100 continue
+	rsSent                 // request has been sent to server
+	rsRecvBody             // response header received, receiving response body
 	rsDone
 )
 
@@ -63,6 +70,9 @@ type Request struct {
 	partial   bool // whether contains only partial request data
 	state     rqState
 	tryCnt    byte
+	route     *routeRule // route rule matching the request, nil if none
+	raced     bool       // server connection created by racing direct and parent
+	trace     []string   // steps of routing decision, refer to traceRoute
 }
 
 // Assume keep-alive request by default.
@@ -125,6 +135,12 @@ func (r *Request) hasSent() bool {
 	return r.state >= rsSent
 }
 
+// bodyBuffered returns true if request body has been read from client and
+// stored in raw buffer.
+func (r *Request) bodyBuffered() bool {
+	return r.raw != nil && r.raw.Len() > r.bodyStart
+}
+
 func (r *Request) releaseBuf() {
 	if r.raw != nil {
 		httpBuf.Put(r.rawByte)
@@ -318,10 +334,12 @@ func ParseRequestURIBytes(rawurl []byte) (*URL, error) {
 // Firefox and Safari send this header along with "Connection" header.
 // See more at http://homepage.ntlworld.com/jonathan.deboynepollard/FGA/web-proxy-connection-header.html
 const (
+	headerAcceptEncoding     = "accept-encoding"
 	headerConnection         = "connection"
 	headerContentLength      = "content-length"
 	headerExpect             = "expect"
 	headerHost               = "host"
+	headerIfNoneMatch        = "if-none-match"
 	headerKeepAlive          = "keep-alive"
 	headerProxyAuthenticate  = "proxy-authenticate"
 	headerProxyAuthorization = "proxy-authorization"
@@ -334,20 +352,24 @@ const (
 
 	fullHeaderConnectionKeepAlive = "Connection: keep-alive\r\n"
 	fullHeaderConnectionClose     = "Connection: close\r\n"
+	fullHeaderConnectionUpgrade   = "Connection: Upgrade\r\n"
 	fullHeaderTransferEncoding    = "Transfer-Encoding: chunked\r\n"
 )
 
 // Using Go's method expression
 var headerParser = map[string]HeaderParserFunc{
+	headerAcceptEncoding:     (*Header).parseAcceptEncoding,
 	headerConnection:         (*Header).parseConnection,
 	headerContentLength:      (*Header).parseContentLength,
 	headerExpect:             (*Header).parseExpect,
 	headerHost:               (*Header).parseHost,
+	headerIfNoneMatch:        (*Header).parseIfNoneMatch,
 	headerKeepAlive:          (*Header).parseKeepAlive,
 	headerProxyAuthorization: (*Header).parseProxyAuthorization,
 	headerProxyConnection:    (*Header).parseConnection,
 	headerTransferEncoding:   (*Header).parseTransferEncoding,
 	headerTrailer:            (*Header).parseTrailer,
+	headerUpgrade:            (*Header).parseUpgrade,
 }
 
 var hopByHopHeader = map[string]bool{
@@ -380,9 +402,26 @@ type HeaderParserFunc func(*Header, []byte) error
 func (h *Header) parseConnection(s []byte) error {
 	ASCIIToLowerInplace(s)
 	h.ConnectionKeepAlive = !bytes.Contains(s, []byte("close"))
+	if bytes.Contains(s, []byte("upgrade")) {
+		// Keep other options like HTTP2-Settings for h2c upgrade.
+		h.ConnectionUpgrade = string(s)
+	}
+	return nil
+}
+
+// Upgrade header is hop-by-hop, it's added back in parseRequest and
+// parseResponse if Connection header contains upgrade.
+func (h *Header) parseUpgrade(s []byte) error {
+	h.Upgrade = string(s)
 	return nil
 }
 
+// isUpgrade returns true if the message asks to switch protocol, e.g.
+// websocket.
+func (h *Header) isUpgrade() bool {
+	return h.ConnectionUpgrade != "" && h.Upgrade != ""
+}
+
 func (h *Header) parseContentLength(s []byte) (err error) {
 	h.ContLen, err = ParseIntFromBytes(s, 10)
 	return err
@@ -446,20 +485,41 @@ func (h *Header) parseTrailer(s []byte) error {
 	return nil
 }
 
-// For now, COW does not fully support 100-continue. It will return "417
-// expectation failed" if a request contains expect header. This is one of the
-// strategies supported by polipo, which is easiest to implement in cow.
-// TODO If we see lots of expect 100-continue usage, provide full support.
-
+// Expect header is forwarded to the server. For 100-continue, COW relays
+// server's 100 response to client before sending request body. Other
+// expectations are left for the server to handle.
 func (h *Header) parseExpect(s []byte) error {
 	ASCIIToLowerInplace(s)
-	errl.Printf("Expect header: %s\n", s) // put here to see if expect header is widely used
-	h.ExpectContinue = true
-	/*
-		if bytes.Contains(s, []byte("100-continue")) {
-			h.ExpectContinue = true
+	if bytes.Contains(s, []byte("100-continue")) {
+		h.ExpectContinue = true
+	}
+	return nil
+}
+
+// parseAcceptEncoding checks whether gzip is acceptable. Content coding is
+// case insensitive, gzip with "q=0" is not acceptable.
+func (h *Header) parseAcceptEncoding(s []byte) error {
+	ASCIIToLowerInplace(s)
+	for _, coding := range strings.Split(string(s), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
 		}
-	*/
+		h.AcceptGzip = true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+					h.AcceptGzip = false
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Header) parseIfNoneMatch(s []byte) error {
+	h.IfNoneMatch = string(s)
 	return nil
 }
 
@@ -631,7 +691,10 @@ func parseRequest(c *clientConn, r *Request) (err error) {
 	if r.Chunking {
 		r.raw.WriteString(fullHeaderTransferEncoding)
 	}
-	if r.ConnectionKeepAlive {
+	if r.isUpgrade() {
+		r.raw.WriteString("Connection: " + r.ConnectionUpgrade + CRLF)
+		r.raw.WriteString("Upgrade: " + r.Upgrade + CRLF)
+	} else if r.ConnectionKeepAlive {
 		r.raw.WriteString(fullHeaderConnectionKeepAlive)
 	} else {
 		r.raw.WriteString(fullHeaderConnectionClose)
@@ -716,10 +779,29 @@ func parseResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 		return CustomHttpErr
 	}
 
-	if rp.Status == statusCodeContinue && !r.ExpectContinue {
-		// not expecting 100-continue, just ignore it and read final response
-		errl.Println("Ignore server 100 response for", r)
-		return parseResponse(sv, r, rp)
+	if rp.Status == statusCodeContinue {
+		if r.state != rsWaitContinue {
+			// not waiting for 100-continue, just ignore it and read final response
+			debug.Println("Ignore server 100 response for", r)
+			return parseResponse(sv, r, rp)
+		}
+		// 1xx response has no body, no need to add any header.
+		rp.raw.WriteString(CRLF)
+		return nil
+	}
+
+	if rp.Status == statusCodeSwitchingProtocols {
+		if !r.isUpgrade() {
+			return fmt.Errorf("switching protocols response to non upgrade request %v", r)
+		}
+		upgrade := rp.Upgrade
+		if upgrade == "" {
+			upgrade = r.Upgrade
+		}
+		rp.raw.WriteString(fullHeaderConnectionUpgrade)
+		rp.raw.WriteString("Upgrade: " + upgrade + CRLF)
+		rp.raw.WriteString(CRLF)
+		return nil
 	}
 
 	if rp.Chunking {
@@ -109,3 +109,22 @@ func TestParseHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAcceptEncoding(t *testing.T) {
+	var testData = []struct {
+		val  string
+		gzip bool
+	}{
+		{"gzip, deflate", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"gzip;q=0, deflate", false},
+		{"x-gzip, br", false},
+	}
+	for _, td := range testData {
+		var h Header
+		h.parseAcceptEncoding([]byte(td.val))
+		if h.AcceptGzip != td.gzip {
+			t.Errorf("%q accept gzip should be %v\n", td.val, td.gzip)
+		}
+	}
+}
@@ -29,6 +29,10 @@ func lookPath() (argv0 string, err error) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "stat" {
+		os.Exit(runStatCmd(os.Args[2:]))
+	}
+
 	quit = make(chan struct{})
 	// Parse flags after load config to allow override options in config
 	cmdLineConfig := parseCmdLineConfig()
@@ -42,12 +46,15 @@ func main() {
 	initSelfListenAddr()
 	initLog()
 	initAuth()
+	initDirectIP() // used when getting visit count of unknown sites
 	initSiteStat()
+	lockStatFile()
 	initPAC() // initPAC uses siteStat, so must init after site stat
 
 	initStat()
 
 	initParentPool()
+	initRoute() // route rules may refer to parent proxy groups
 
 	/*
 		if *cpuprofile != "" {
@@ -28,3 +28,8 @@ func sigHandler() {
 		}
 	*/
 }
+
+func isProcessRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
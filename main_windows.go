@@ -31,3 +31,13 @@ func sigHandler() {
 		}
 	*/
 }
+
+func isProcessRunning(pid int) bool {
+	// FindProcess opens the process on Windows, so fails if it's not running.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
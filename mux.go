@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Multiplexing for cow protocol, which carries many streams over a single
+// encrypted connection between cow client and cow server.
+//
+// Client starts a mux session by sending muxMagic on the encrypted
+// connection. As HTTP request can't start with 0, cow server can serve both
+// plain and mux clients on the same address.
+//
+// Each frame has the format:
+//
+//	+-----+-----------+--------+---------+
+//	| cmd | stream id | length | payload |
+//	+-----+-----------+--------+---------+
+//	|  1  |     4     |   2    | length  |
+//	+-----+-----------+--------+---------+
+//
+// Only client opens streams. For flow control, each stream can have at most
+// muxWindow bytes unread by the receiver. Receiver returns window to sender
+// with muxCmdWnd frame, which has 4 bytes window increment as payload.
+var muxMagic = []byte{0, 'C', 'O', 'W', 'M', 'U', 'X', 1}
+
+const (
+	muxCmdSyn  byte = iota // open stream
+	muxCmdData             // stream data
+	muxCmdWnd              // window update
+	muxCmdFin              // stream closed by sender
+)
+
+const (
+	muxHeaderLen    = 7
+	muxMaxPayload   = 16 * 1024
+	muxWindow       = 256 * 1024
+	muxWriteTimeout = 30 * time.Second
+)
+
+var (
+	errMuxClosed       = errors.New("mux session closed")
+	errMuxStreamClosed = errors.New("mux stream closed")
+)
+
+type muxTimeoutError struct{}
+
+func (e muxTimeoutError) Error() string   { return "mux stream i/o timeout" }
+func (e muxTimeoutError) Timeout() bool   { return true }
+func (e muxTimeoutError) Temporary() bool { return true }
+
+type muxSession struct {
+	conn net.Conn
+	wmu  sync.Mutex // serialize frame writing
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error           // not nil after session is closed
+	accept  chan *muxStream // streams opened by client, nil on client side
+}
+
+func newMuxSession(conn net.Conn, server bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+	}
+	if server {
+		s.accept = make(chan *muxStream, 64)
+	}
+	go s.recvLoop()
+	return s
+}
+
+func (s *muxSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+func (s *muxSession) numStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newMuxStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID++
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxCmdSyn, st.id, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	debug.Printf("mux session %s closed: %v\n", s.conn.RemoteAddr(), err)
+	s.err = errMuxClosed
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.sessionClosed(errMuxClosed)
+	}
+}
+
+func (s *muxSession) writeFrame(cmd byte, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderLen+len(payload))
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], id)
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(payload)))
+	copy(buf[muxHeaderLen:], payload)
+
+	s.wmu.Lock()
+	s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	_, err := s.conn.Write(buf)
+	s.wmu.Unlock()
+	if err != nil {
+		s.close(err)
+		return errMuxClosed
+	}
+	return nil
+}
+
+func (s *muxSession) recvLoop() {
+	hdr := make([]byte, muxHeaderLen)
+	var err error
+	for {
+		if _, err = io.ReadFull(s.conn, hdr); err != nil {
+			break
+		}
+		cmd := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:])
+		var payload []byte
+		if n := binary.BigEndian.Uint16(hdr[5:]); n > 0 {
+			payload = make([]byte, n)
+			if _, err = io.ReadFull(s.conn, payload); err != nil {
+				break
+			}
+		}
+		if err = s.handleFrame(cmd, id, payload); err != nil {
+			errl.Printf("mux session %s: %v\n", s.conn.RemoteAddr(), err)
+			break
+		}
+	}
+	s.close(err)
+	if s.accept != nil {
+		close(s.accept)
+	}
+}
+
+func (s *muxSession) handleFrame(cmd byte, id uint32, payload []byte) error {
+	if cmd == muxCmdSyn {
+		if s.accept == nil {
+			return errors.New("stream opened by server")
+		}
+		st := newMuxStream(s, id)
+		s.mu.Lock()
+		_, dup := s.streams[id]
+		if !dup {
+			s.streams[id] = st
+		}
+		s.mu.Unlock()
+		if dup {
+			return fmt.Errorf("duplicate stream %d", id)
+		}
+		s.accept <- st
+		return nil
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil {
+		// Stream already closed on our side, drop the frame.
+		return nil
+	}
+	switch cmd {
+	case muxCmdData:
+		return st.pushData(payload)
+	case muxCmdWnd:
+		if len(payload) != 4 {
+			return errors.New("invalid window update")
+		}
+		st.addSendWindow(binary.BigEndian.Uint32(payload))
+	case muxCmdFin:
+		st.remoteClose()
+	default:
+		return fmt.Errorf("unknown command %d", cmd)
+	}
+	return nil
+}
+
+// muxStream implements net.Conn.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte // received but not read data
+	consumed  uint32 // read data not yet returned to sender as window
+	sendWnd   uint32
+	rdeadline time.Time
+	wdeadline time.Time
+	rtimer    *time.Timer
+	wtimer    *time.Timer
+	finRecv   bool
+	closed    bool
+	err       error // session error
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	st := &muxStream{id: id, sess: s, sendWnd: muxWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *muxStream) String() string {
+	return fmt.Sprintf("mux stream %d of %s", st.id, st.sess.conn.RemoteAddr())
+}
+
+func isDeadlinePassed(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (st *muxStream) Read(b []byte) (n int, err error) {
+	st.mu.Lock()
+	for len(st.buf) == 0 {
+		switch {
+		case st.closed:
+			err = errMuxStreamClosed
+		case st.finRecv:
+			err = io.EOF
+		case st.err != nil:
+			err = st.err
+		case isDeadlinePassed(st.rdeadline):
+			err = muxTimeoutError{}
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return 0, err
+		}
+		st.cond.Wait()
+	}
+	n = copy(b, st.buf)
+	st.buf = st.buf[n:]
+	if len(st.buf) == 0 {
+		st.buf = nil
+	}
+	// Return window in batch to avoid sending too many window updates.
+	var inc uint32
+	st.consumed += uint32(n)
+	if st.consumed >= muxWindow/2 && !st.finRecv {
+		inc = st.consumed
+		st.consumed = 0
+	}
+	st.mu.Unlock()
+
+	if inc > 0 {
+		wnd := make([]byte, 4)
+		binary.BigEndian.PutUint32(wnd, inc)
+		st.sess.writeFrame(muxCmdWnd, st.id, wnd)
+	}
+	return n, nil
+}
+
+func (st *muxStream) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		st.mu.Lock()
+		for {
+			switch {
+			case st.closed, st.finRecv:
+				err = errMuxStreamClosed
+			case st.err != nil:
+				err = st.err
+			case isDeadlinePassed(st.wdeadline):
+				err = muxTimeoutError{}
+			}
+			if err != nil || st.sendWnd > 0 {
+				break
+			}
+			st.cond.Wait()
+		}
+		if err != nil {
+			st.mu.Unlock()
+			return
+		}
+		m := len(b) - n
+		if m > muxMaxPayload {
+			m = muxMaxPayload
+		}
+		if uint32(m) > st.sendWnd {
+			m = int(st.sendWnd)
+		}
+		st.sendWnd -= uint32(m)
+		st.mu.Unlock()
+
+		if err = st.sess.writeFrame(muxCmdData, st.id, b[n:n+m]); err != nil {
+			return
+		}
+		n += m
+	}
+	return
+}
+
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	st.stopTimer()
+	st.cond.Broadcast()
+	sessErr := st.err
+	st.mu.Unlock()
+
+	st.sess.remove(st.id)
+	if sessErr != nil {
+		return nil
+	}
+	return st.sess.writeFrame(muxCmdFin, st.id, nil)
+}
+
+func (st *muxStream) pushData(b []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.buf)+int(st.consumed)+len(b) > muxWindow {
+		return fmt.Errorf("stream %d receive window exceeded", st.id)
+	}
+	st.buf = append(st.buf, b...)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *muxStream) addSendWindow(inc uint32) {
+	st.mu.Lock()
+	st.sendWnd += inc
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *muxStream) sessionClosed(err error) {
+	st.mu.Lock()
+	st.err = err
+	st.stopTimer()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// Must hold st.mu when calling stopTimer.
+func (st *muxStream) stopTimer() {
+	if st.rtimer != nil {
+		st.rtimer.Stop()
+		st.rtimer = nil
+	}
+	if st.wtimer != nil {
+		st.wtimer.Stop()
+		st.wtimer = nil
+	}
+}
+
+func (st *muxStream) wakeup() {
+	st.mu.Lock()
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// Must hold st.mu when calling setDeadline.
+func (st *muxStream) setDeadline(deadline *time.Time, timer **time.Timer, t time.Time) {
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(t.Sub(time.Now()), st.wakeup)
+	}
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.setDeadline(&st.rdeadline, &st.rtimer, t)
+	st.mu.Unlock()
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.setDeadline(&st.wdeadline, &st.wtimer, t)
+	st.mu.Unlock()
+	return nil
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.setDeadline(&st.rdeadline, &st.rtimer, t)
+	st.setDeadline(&st.wdeadline, &st.wtimer, t)
+	st.mu.Unlock()
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+// muxClient opens streams over at most len(session) mux sessions. New
+// streams are put on the session with fewest streams, new session is
+// created only if all sessions are in use.
+type muxClient struct {
+	dial func() (net.Conn, error)
+
+	sync.Mutex
+	session []*muxSession
+}
+
+func newMuxClient(size int, dial func() (net.Conn, error)) *muxClient {
+	return &muxClient{dial: dial, session: make([]*muxSession, size)}
+}
+
+func (mc *muxClient) open() (st *muxStream, err error) {
+	// Session may be broken without being noticed, so retry once with new
+	// session if opening stream fails.
+	for i := 0; i < 2; i++ {
+		var sess *muxSession
+		if sess, err = mc.getSession(); err != nil {
+			return nil, err
+		}
+		if st, err = sess.open(); err == nil {
+			return st, nil
+		}
+	}
+	return nil, err
+}
+
+func (mc *muxClient) getSession() (*muxSession, error) {
+	mc.Lock()
+	free := -1
+	var best *muxSession
+	min := 0
+	for i, sess := range mc.session {
+		if sess == nil || sess.isClosed() {
+			if free == -1 {
+				free = i
+			}
+			continue
+		}
+		if n := sess.numStreams(); best == nil || n < min {
+			best, min = sess, n
+		}
+	}
+	mc.Unlock()
+	// Create new session only if all existing sessions are in use.
+	if best != nil && (min == 0 || free == -1) {
+		return best, nil
+	}
+
+	// Don't hold lock when dialing.
+	c, err := mc.dial()
+	if err != nil {
+		return nil, err
+	}
+	sess := newMuxSession(c, false)
+	mc.Lock()
+	if old := mc.session[free]; old != nil && !old.isClosed() {
+		// Another goroutine created session concurrently.
+		mc.Unlock()
+		sess.close(errMuxClosed)
+		return old, nil
+	}
+	mc.session[free] = sess
+	mc.Unlock()
+	return sess, nil
+}
+
+// prefixConn returns prefix before data read from Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newMuxPair returns client and server session over a TCP connection.
+func newMuxPair(t *testing.T) (cli, srv *muxSession) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMuxSession(c1, false), newMuxSession(c2, true)
+}
+
+func TestMuxStream(t *testing.T) {
+	cli, srv := newMuxPair(t)
+	defer cli.close(errMuxClosed)
+
+	// Echo server.
+	go func() {
+		for st := range srv.accept {
+			go func(st *muxStream) {
+				io.Copy(st, st)
+				st.Close()
+			}(st)
+		}
+	}()
+
+	const nstream = 5
+	done := make(chan error, nstream)
+	for i := 0; i < nstream; i++ {
+		go func(i int) {
+			st, err := cli.open()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer st.Close()
+			data := bytes.Repeat([]byte{byte('a' + i)}, 3*muxMaxPayload+i)
+			go st.Write(data)
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(st, got); err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				done <- io.ErrUnexpectedEOF
+				return
+			}
+			done <- nil
+		}(i)
+	}
+	for i := 0; i < nstream; i++ {
+		if err := <-done; err != nil {
+			t.Error("stream echo:", err)
+		}
+	}
+
+	st, _ := cli.open()
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !isErrTimeout(err) {
+		t.Error("read should time out, got:", err)
+	}
+
+	// Closing session should fail all streams.
+	srv.close(errMuxClosed)
+	st.SetReadDeadline(time.Time{})
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Error("read on closed session should fail")
+	}
+	if _, err := cli.open(); err == nil {
+		t.Error("open on closed session should fail")
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	cli, srv := newMuxPair(t)
+	defer cli.close(errMuxClosed)
+
+	st, err := cli.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst := <-srv.accept
+
+	// Writer should block after using up window if receiver does not read.
+	data := make([]byte, 2*muxWindow)
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(data)
+	if !isErrTimeout(err) || n != muxWindow {
+		t.Fatalf("write should block after %d bytes, written %d, err: %v", muxWindow, n, err)
+	}
+
+	// Reading returns window to writer.
+	st.SetWriteDeadline(time.Time{})
+	go func() {
+		st.Write(data[n:])
+		st.Close()
+	}()
+	got, err := readAll(sst)
+	if err != nil {
+		t.Fatal("read stream:", err)
+	}
+	if len(got) != len(data) {
+		t.Errorf("should read %d bytes, got %d\n", len(data), len(got))
+	}
+	if _, err := sst.Write([]byte("x")); err == nil {
+		t.Error("write after remote close should fail")
+	}
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, r)
+	return buf.Bytes(), err
+}
+
+func TestCowParentMux(t *testing.T) {
+	initConfig("")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				io.Copy(c, c)
+				c.Close()
+			}(c)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cp := newCowProxy("aes-128-cfb", "foobar", ln.Addr().String())
+	var nconn int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&nconn, 1)
+			go cp.serveConn(c)
+		}
+	}()
+
+	parent := newCowParent(ln.Addr().String(), "aes-128-cfb", "foobar")
+	parent.initMux(1)
+	if !strings.HasSuffix(parent.genConfig(), " mux=1") {
+		t.Error("cow parent config should contain mux option:", parent.genConfig())
+	}
+	url := &URL{}
+	url.ParseHostPort(target.Addr().String())
+	config.TunnelAllowedPort[url.Port] = true
+	defer delete(config.TunnelAllowedPort, url.Port)
+	for i := 0; i < 3; i++ {
+		c, err := parent.connect(url)
+		if err != nil {
+			t.Fatal("connect cow parent:", err)
+		}
+		if _, ok := c.(cowConn); !ok {
+			t.Fatal("cow parent should return cowConn")
+		}
+		if err := httpConnectTunnel(c, target.Addr().String(), nil); err != nil {
+			t.Fatal("CONNECT through mux stream:", err)
+		}
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("tunnel should echo data, got %q %v\n", buf, err)
+		}
+		c.Close()
+	}
+	if atomic.LoadInt32(&nconn) != 1 {
+		t.Errorf("streams should share one connection, created %d\n", nconn)
+	}
+
+	// Plain cow client should still work on the same address.
+	plain := newCowParent(ln.Addr().String(), "aes-128-cfb", "foobar")
+	c, err := plain.connect(url)
+	if err != nil {
+		t.Fatal("connect plain cow parent:", err)
+	}
+	defer c.Close()
+	if err := httpConnectTunnel(c, target.Addr().String(), nil); err != nil {
+		t.Error("CONNECT through plain cow connection:", err)
+	}
+}
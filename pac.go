@@ -2,41 +2,113 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 )
 
+// User specified rules in PAC.
+type pacRules struct {
+	DirectRules   string
+	DirectExcept  string
+	BlockedRules  string
+	BlockedExcept string
+	DirectIP      string
+}
+
+// pacListen is a listen address which can be used in PAC.
+type pacListen struct {
+	Type string // PROXY, HTTPS or SOCKS5
+	Addr string
+}
+
+// pacData is passed to PAC template. Domain lists are quoted and separated
+// by comma, to be put in JavaScript array with enclosing quotes.
+type pacData struct {
+	ProxyType      string
+	ProxyAddr      string
+	DirectDomains  string
+	BlockedDomains string
+	TopLevel       string
+	Listen         []pacListen
+	pacRules
+}
+
 var pac struct {
-	template       *template.Template
-	topLevelDomain string
-	directList     string
+	template        *template.Template
+	builtinTemplate *template.Template
+	templateMod     time.Time // modification time of user template file
+	templateHash    uint64    // hash of template in use, used in ETag
+	builtinHash     uint64
+	topLevelDomain  string
+	directList      string
+	blockedList     string
+	rules           pacRules
+	version         uint64 // hash of domain lists and rules, used in ETag
 	// Assignments and reads to directList are in different goroutines. Go
 	// does not guarantee atomic assignment, so we should protect these racing
 	// access.
 	dLRWMutex sync.RWMutex
 }
 
-func getDirectList() string {
+func getDirectList() (dl, bl string, rules pacRules, version uint64) {
 	pac.dLRWMutex.RLock()
-	dl := pac.directList
+	dl = pac.directList
+	bl = pac.blockedList
+	rules = pac.rules
+	version = pac.version
 	pac.dLRWMutex.RUnlock()
-	return dl
+	return
+}
+
+func getPACTemplate() (*template.Template, uint64) {
+	pac.dLRWMutex.RLock()
+	defer pac.dLRWMutex.RUnlock()
+	return pac.template, pac.templateHash
+}
+
+// useBuiltinPACTemplate is called when user template fails to execute. The
+// builtin template is used until the template file is modified.
+func useBuiltinPACTemplate() {
+	pac.dLRWMutex.Lock()
+	pac.template = pac.builtinTemplate
+	pac.templateHash = pac.builtinHash
+	pac.dLRWMutex.Unlock()
 }
 
 func updateDirectList() {
 	dl := strings.Join(siteStat.GetDirectList(), "\",\n\"")
+	bl := strings.Join(siteStat.GetBlockedList(), "\",\n\"")
+	var rules pacRules
+	rules.DirectRules, rules.DirectExcept = siteStat.directRules.pacRules()
+	rules.BlockedRules, rules.BlockedExcept = siteStat.blockedRules.pacRules()
+	rules.DirectIP = directIP.pacRanges()
+	// Derive version from content, so ETag is still valid after restart if
+	// nothing changes.
+	h := fnv.New64a()
+	for _, s := range []string{dl, bl, rules.DirectRules, rules.DirectExcept,
+		rules.BlockedRules, rules.BlockedExcept, rules.DirectIP} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
 	pac.dLRWMutex.Lock()
 	pac.directList = dl
+	pac.blockedList = bl
+	pac.rules = rules
+	pac.version = h.Sum64()
 	pac.dLRWMutex.Unlock()
 }
 
 func init() {
 	const pacRawTmpl = `var direct = 'DIRECT';
-var httpProxy = 'PROXY {{.ProxyAddr}}; DIRECT';
+var httpProxy = '{{.ProxyType}} {{.ProxyAddr}}; DIRECT';
 
 var directList = [
 "",
@@ -52,6 +124,25 @@ var topLevel = {
 {{.TopLevel}}
 };
 
+// User specified rules, each rule has the form [type, pattern...].
+var directRules = [
+{{.DirectRules}}
+];
+var directExcept = [
+{{.DirectExcept}}
+];
+var blockedRules = [
+{{.BlockedRules}}
+];
+var blockedExcept = [
+{{.BlockedExcept}}
+];
+
+// Sorted IPv4 ranges visited directly, each has the form [start, end].
+var directIP = [
+{{.DirectIP}}
+];
+
 // hostIsIP determines whether a host address is an IP address and whether
 // it is private. Currenly only handles IPv4 addresses.
 function hostIsIP(host) {
@@ -113,6 +204,58 @@ function host2Domain(host) {
 	return host.substring(dot2ndLast+1);
 }
 
+function ruleMatch(rule, host) {
+	switch (rule[0]) {
+	case "s": // domain suffix
+		return host == rule[1] || dnsDomainIs(host, "." + rule[1]);
+	case "w": // wildcard
+		return shExpMatch(host, rule[1]);
+	case "r": // regexp
+		return new RegExp(rule[1]).test(host);
+	case "n": // IPv4 network, only for host given as IP address
+		return hostIsIP(host)[0] && isInNet(host, rule[1], rule[2]);
+	}
+	return false;
+}
+
+function listMatch(rules, host) {
+	for (var i = 0; i < rules.length; i += 1) {
+		if (ruleMatch(rules[i], host)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function ip2Num(ip) {
+	var part = ip.split('.');
+	return ((Number(part[0]) * 256 + Number(part[1])) * 256 + Number(part[2])) * 256 + Number(part[3]);
+}
+
+// Binary search in directIP, faster than isInNet for large number of ranges.
+function inDirectIP(host) {
+	if (directIP.length === 0) {
+		return false;
+	}
+	var ip = hostIsIP(host)[0] ? host : dnsResolve(host);
+	if (!ip || !hostIsIP(ip)[0]) {
+		return false;
+	}
+	var n = ip2Num(ip);
+	var lo = 0, hi = directIP.length - 1;
+	while (lo <= hi) {
+		var mid = (lo + hi) >> 1;
+		if (n < directIP[mid][0]) {
+			hi = mid - 1;
+		} else if (n > directIP[mid][1]) {
+			lo = mid + 1;
+		} else {
+			return true;
+		}
+	}
+	return false;
+}
+
 function FindProxyForURL(url, host) {
 	if (url.substring(0,4) == "ftp:")
 		return direct;
@@ -121,18 +264,35 @@ function FindProxyForURL(url, host) {
 	if (host.indexOf(".local", host.length - 6) !== -1) {
 		return direct;
 	}
+	host = host.toLowerCase();
+	if (listMatch(blockedRules, host) && !listMatch(blockedExcept, host)) {
+		return httpProxy;
+	}
+	// Let cow decide for hosts excluded from direct list.
+	if (listMatch(directExcept, host)) {
+		return httpProxy;
+	}
+	if (listMatch(directRules, host)) {
+		return direct;
+	}
 	var domain = host2Domain(host);
-	if (host.length == domain.length) {
-		return directAcc[host] ? direct : httpProxy;
+	if (directAcc[host] || (host.length != domain.length && directAcc[domain])) {
+		return direct;
 	}
-	return (directAcc[host] || directAcc[domain]) ? direct : httpProxy;
+	return inDirectIP(host) ? direct : httpProxy;
 }
 `
 	var err error
-	pac.template, err = template.New("pac").Parse(pacRawTmpl)
+	pac.builtinTemplate, err = template.New("pac").Parse(pacRawTmpl)
 	if err != nil {
 		Fatal("Internal error on generating pac file template:", err)
 	}
+	pac.template = pac.builtinTemplate
+	// ETag should change if builtin template changes in new release.
+	h := fnv.New64a()
+	h.Write([]byte(pacRawTmpl))
+	pac.builtinHash = h.Sum64()
+	pac.templateHash = pac.builtinHash
 
 	var buf bytes.Buffer
 	for k, _ := range topLevelDomain {
@@ -141,12 +301,12 @@ function FindProxyForURL(url, host) {
 	pac.topLevelDomain = buf.String()[:buf.Len()-2] // remove the final comma
 }
 
-// No need for content-length as we are closing connection
-var pacHeader = []byte("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n" +
-	"Content-Type: application/x-ns-proxy-autoconfig\r\nConnection: close\r\n\r\n")
+// Browser may cache PAC for this long, and revalidate with ETag after that.
+const pacMaxAge = 60
 
-// Different client will have different proxy URL, so generate it upon each request.
-func genPAC(c *clientConn) []byte {
+// Different client will have different proxy URL, so generate it upon each
+// request. Returns PAC content and its ETag.
+func genPAC(c *clientConn) ([]byte, string, error) {
 	buf := new(bytes.Buffer)
 
 	hproxy, ok := c.proxy.(*httpProxy)
@@ -165,50 +325,216 @@ func genPAC(c *clientConn) []byte {
 		}
 		proxyAddr = net.JoinHostPort(host, hproxy.port)
 	}
+	// HTTPS directive is supported by Chrome and Firefox.
+	proxyType := "PROXY"
+	if hproxy.isTLS {
+		proxyType = "HTTPS"
+	}
 
-	dl := getDirectList()
+	dl, bl, rules, version := getDirectList()
+	tmpl, tmplHash := getPACTemplate()
+	listen := pacListenAddr(c)
+	// Proxy address and listen addresses used by template are part of PAC
+	// content.
+	h := fnv.New32a()
+	h.Write([]byte(proxyType + " " + proxyAddr))
+	for _, l := range listen {
+		h.Write([]byte("\n" + l.Type + " " + l.Addr))
+	}
+	etag := fmt.Sprintf("\"%x-%x\"", version^tmplHash, h.Sum32())
 
-	if dl == "" {
+	if config.PacTemplateFile == "" && dl == "" && rules.DirectRules == "" && rules.DirectIP == "" {
 		// Empty direct domain list
-		buf.Write(pacHeader)
-		pacproxy := fmt.Sprintf("function FindProxyForURL(url, host) { return 'PROXY %s; DIRECT'; };",
-			proxyAddr)
+		pacproxy := fmt.Sprintf("function FindProxyForURL(url, host) { return '%s %s; DIRECT'; };",
+			proxyType, proxyAddr)
 		buf.Write([]byte(pacproxy))
-		return buf.Bytes()
+		return buf.Bytes(), etag, nil
 	}
 
-	data := struct {
-		ProxyAddr     string
-		DirectDomains string
-		TopLevel      string
-	}{
-		proxyAddr,
-		dl,
-		pac.topLevelDomain,
+	data := pacData{
+		ProxyType:      proxyType,
+		ProxyAddr:      proxyAddr,
+		DirectDomains:  dl,
+		BlockedDomains: bl,
+		TopLevel:       pac.topLevelDomain,
+		Listen:         listen,
+		pacRules:       rules,
+	}
+	if err := tmpl.Execute(buf, data); err != nil {
+		// User template may fail on data not covered when loading, e.g.
+		// index out of range on listen addresses.
+		if tmpl != pac.builtinTemplate {
+			useBuiltinPACTemplate()
+			err = fmt.Errorf("%v, use builtin template until template file is modified", err)
+		}
+		return nil, "", fmt.Errorf("error generating PAC: %v", err)
 	}
+	return buf.Bytes(), etag, nil
+}
 
-	buf.Write(pacHeader)
-	if err := pac.template.Execute(buf, data); err != nil {
-		errl.Println("Error generating pac file:", err)
-		panic("Error generating pac file")
+// pacListenAddr returns address of HTTP and SOCKS listeners to use in PAC.
+// Unspecified listen IP is replaced with the IP client connects to.
+func pacListenAddr(c *clientConn) []pacListen {
+	var lst []pacListen
+	for _, proxy := range listenProxy {
+		var typ, addr string
+		switch p := proxy.(type) {
+		case *httpProxy:
+			typ, addr = "PROXY", p.addr
+			if p.isTLS {
+				typ = "HTTPS"
+			}
+			if p.addrInPAC != "" {
+				lst = append(lst, pacListen{typ, p.addrInPAC})
+				continue
+			}
+		case *socksProxy:
+			typ, addr = "SOCKS5", p.addr
+		default:
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			if host, _, err = net.SplitHostPort(c.LocalAddr().String()); err != nil {
+				continue
+			}
+		}
+		lst = append(lst, pacListen{typ, net.JoinHostPort(host, port)})
 	}
-	return buf.Bytes()
+	return lst
+}
+
+// loadPACTemplate parses user PAC template. The template is executed with
+// sample data, so errors like wrong field name are found when loading.
+func loadPACTemplate(fpath string) (*template.Template, []byte, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := template.New("pac").Parse(string(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	sample := pacData{
+		ProxyType:      "PROXY",
+		ProxyAddr:      "127.0.0.1:7777",
+		DirectDomains:  "direct.example.com",
+		BlockedDomains: "blocked.example.com",
+		TopLevel:       pac.topLevelDomain,
+		Listen:         []pacListen{{"PROXY", "127.0.0.1:7777"}, {"SOCKS5", "127.0.0.1:1080"}},
+	}
+	if err = tmpl.Execute(ioutil.Discard, sample); err != nil {
+		return nil, nil, err
+	}
+	return tmpl, b, nil
+}
+
+// reloadPACTemplate loads user PAC template if it's modified. Returns true if
+// template is reloaded.
+func reloadPACTemplate(fpath string) (bool, error) {
+	stat, err := os.Stat(fpath)
+	if err != nil {
+		return false, err
+	}
+	pac.dLRWMutex.RLock()
+	modTime := pac.templateMod
+	pac.dLRWMutex.RUnlock()
+	if stat.ModTime().Equal(modTime) {
+		return false, nil
+	}
+	tmpl, b, err := loadPACTemplate(fpath)
+	if err != nil {
+		return false, fmt.Errorf("PAC template %s: %v", fpath, err)
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	pac.dLRWMutex.Lock()
+	pac.template = tmpl
+	pac.templateMod = stat.ModTime()
+	pac.templateHash = h.Sum64()
+	pac.dLRWMutex.Unlock()
+	return true, nil
+}
+
+// etagMatch checks whether etag matches value of If-None-Match header.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 func initPAC() {
+	if config.PacTemplateFile != "" {
+		if _, err := reloadPACTemplate(config.PacTemplateFile); err != nil {
+			Fatal(err)
+		}
+	}
 	// we can't control goroutine scheduling, make sure when
 	// initPAC is done, direct list is updated
 	updateDirectList()
 	go func() {
 		for {
 			time.Sleep(time.Minute)
+			if config.PacTemplateFile != "" {
+				// Keep using the old template on error.
+				if ok, err := reloadPACTemplate(config.PacTemplateFile); err != nil {
+					errl.Println(err)
+				} else if ok {
+					info.Println("PAC template reloaded")
+				}
+			}
 			updateDirectList()
 		}
 	}()
 }
 
-func sendPAC(c *clientConn) error {
-	_, err := c.Write(genPAC(c))
+// sendPAC sends PAC to client, or 304 if client has the same PAC.
+// Connection is kept alive if client asks so.
+func sendPAC(c *clientConn, r *Request) error {
+	body, etag, err := genPAC(c)
+	if err != nil {
+		errl.Println(err)
+		sendErrorPage(c, "500 internal error", "Error generating PAC", err.Error())
+		return err
+	}
+	if r.AcceptGzip {
+		// Gzipped PAC is a different representation, needs its own ETag.
+		etag = etag[:len(etag)-1] + "-gz\""
+	}
+	var buf bytes.Buffer
+	if r.IfNoneMatch != "" && etagMatch(r.IfNoneMatch, etag) {
+		buf.WriteString("HTTP/1.1 304 Not Modified\r\nServer: cow-proxy\r\n")
+		body = nil
+	} else {
+		buf.WriteString("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n" +
+			"Content-Type: application/x-ns-proxy-autoconfig\r\n" +
+			"Vary: Accept-Encoding\r\n")
+		if r.AcceptGzip {
+			var zbuf bytes.Buffer
+			zw := gzip.NewWriter(&zbuf)
+			zw.Write(body)
+			zw.Close()
+			body = zbuf.Bytes()
+			buf.WriteString("Content-Encoding: gzip\r\n")
+		}
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(body))
+	}
+	fmt.Fprintf(&buf, "ETag: %s\r\nCache-Control: max-age=%d\r\n", etag, pacMaxAge)
+	if r.ConnectionKeepAlive {
+		buf.WriteString(fullHeaderConnectionKeepAlive)
+	} else {
+		buf.WriteString(fullHeaderConnectionClose)
+	}
+	buf.WriteString(CRLF)
+	buf.Write(body)
+	_, err = c.Write(buf.Bytes())
 	if err != nil {
 		debug.Printf("cli(%s) error sending PAC: %s", c.RemoteAddr(), err)
 	}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readPAC returns response to PAC request with header h.
+func readPAC(t *testing.T, h Header) (status string, header textproto.MIMEHeader, body []byte) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	c := newClientConn(c1, newHttpProxy("127.0.0.1:7777", "127.0.0.1:7777"))
+	go sendPAC(c, &Request{Header: h})
+
+	rd := bufio.NewReader(c2)
+	tr := textproto.NewReader(rd)
+	status, err := tr.ReadLine()
+	if err != nil {
+		t.Fatal("read PAC status:", err)
+	}
+	if header, err = tr.ReadMIMEHeader(); err != nil {
+		t.Fatal("read PAC header:", err)
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		body = make([]byte, n)
+		if _, err = io.ReadFull(rd, body); err != nil {
+			t.Fatal("read PAC body:", err)
+		}
+	}
+	return
+}
+
+func TestSendPAC(t *testing.T) {
+	status, header, body := readPAC(t, Header{ConnectionKeepAlive: true})
+	if status != "HTTP/1.1 200 OK" {
+		t.Fatal("wrong status:", status)
+	}
+	if header.Get("Connection") != "keep-alive" {
+		t.Error("connection should be kept alive")
+	}
+	etag := header.Get("ETag")
+	if etag == "" || header.Get("Cache-Control") == "" {
+		t.Error("PAC should have ETag and Cache-Control")
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	plain, _, _ := genPAC(newClientConn(c1, newHttpProxy("127.0.0.1:7777", "127.0.0.1:7777")))
+	if string(body) != string(plain) {
+		t.Error("PAC content wrong")
+	}
+
+	status, header, body = readPAC(t, Header{IfNoneMatch: `"other", ` + etag})
+	if status != "HTTP/1.1 304 Not Modified" || len(body) != 0 {
+		t.Error("should reply 304 for matching ETag, got", status)
+	}
+	if header.Get("Connection") != "close" {
+		t.Error("connection should be closed if client does not keep alive")
+	}
+
+	_, header, body = readPAC(t, Header{AcceptGzip: true, IfNoneMatch: `"other"`})
+	if header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("PAC should be gzipped if client accepts gzip")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unzipped, err := ioutil.ReadAll(zr); err != nil || string(unzipped) != string(plain) {
+		t.Error("gzipped PAC content wrong:", err)
+	}
+	gzETag := header.Get("ETag")
+	if gzETag == etag {
+		t.Error("gzipped PAC should have different ETag")
+	}
+	status, _, _ = readPAC(t, Header{AcceptGzip: true, IfNoneMatch: etag})
+	if status != "HTTP/1.1 200 OK" {
+		t.Error("ETag of identity PAC should not match gzipped PAC, got", status)
+	}
+	status, _, _ = readPAC(t, Header{AcceptGzip: true, IfNoneMatch: gzETag})
+	if status != "HTTP/1.1 304 Not Modified" {
+		t.Error("should reply 304 for matching gzipped PAC ETag, got", status)
+	}
+}
+
+func TestPACTemplate(t *testing.T) {
+	savedTmpl, savedMod, savedHash := pac.template, pac.templateMod, pac.templateHash
+	savedFile, savedListen := config.PacTemplateFile, listenProxy
+	defer func() {
+		pac.template, pac.templateMod, pac.templateHash = savedTmpl, savedMod, savedHash
+		config.PacTemplateFile, listenProxy = savedFile, savedListen
+	}()
+	saved := siteStat
+	defer func() {
+		siteStat = saved
+		updateDirectList()
+	}()
+	siteStat = newSiteStat()
+	siteStat.loadList([]string{"blocked.com"}, 0, userCnt)
+	updateDirectList()
+
+	tmpDir, err := ioutil.TempDir("", "cow-pac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fpath := path.Join(tmpDir, "pac.tmpl")
+	config.PacTemplateFile = fpath
+	listenProxy = []Proxy{newHttpProxy("0.0.0.0:7777", ""), newSocksProxy("0.0.0.0:1080")}
+
+	writeTmpl := func(content string, mod time.Time) {
+		if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fpath, mod, mod)
+	}
+	now := time.Now()
+	writeTmpl(`var blocked = ["{{.BlockedDomains}}"];
+{{range .Listen}}// {{.Type}} {{.Addr}}
+{{end}}`, now.Add(-time.Minute))
+	if ok, err := reloadPACTemplate(fpath); !ok || err != nil {
+		t.Fatal("load PAC template:", err)
+	}
+	if ok, _ := reloadPACTemplate(fpath); ok {
+		t.Error("template not modified should not be reloaded")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClientConn(conn, listenProxy[0].(*httpProxy))
+	defer c.Close()
+	b, etag, _ := genPAC(c)
+	want := "var blocked = [\"blocked.com\"];\n// PROXY 127.0.0.1:7777\n// SOCKS5 127.0.0.1:1080\n"
+	if string(b) != want {
+		t.Errorf("PAC from template wrong, got\n%s\nwant\n%s", b, want)
+	}
+
+	listenProxy = append(listenProxy, newSocksProxy("0.0.0.0:1081"))
+	if _, etag2, _ := genPAC(c); etag2 == etag {
+		t.Error("ETag should change with listen address")
+	}
+	listenProxy = listenProxy[:2]
+
+	writeTmpl(`{{.NoSuchField}}`, now)
+	if _, err := reloadPACTemplate(fpath); err == nil || !strings.Contains(err.Error(), "NoSuchField") {
+		t.Error("invalid template should return error, got", err)
+	}
+	if b2, _, _ := genPAC(c); string(b2) != want {
+		t.Error("should keep using old template on error")
+	}
+
+	writeTmpl(`// {{.ProxyType}} {{.ProxyAddr}}`, now.Add(time.Minute))
+	if ok, err := reloadPACTemplate(fpath); !ok || err != nil {
+		t.Fatal("reload PAC template:", err)
+	}
+	if b, etag2, _ := genPAC(c); string(b) != "// PROXY 127.0.0.1:7777" || etag2 == etag {
+		t.Errorf("reloaded template should be used with new ETag, got %s %s\n", b, etag2)
+	}
+
+	// Error not found when loading should not bring down the proxy.
+	writeTmpl(`{{index .Listen 1}}`, now.Add(2*time.Minute))
+	if ok, err := reloadPACTemplate(fpath); !ok || err != nil {
+		t.Fatal("reload PAC template:", err)
+	}
+	listenProxy = []Proxy{newHttpProxy("127.0.0.1:7777", "")}
+	if status, _, _ := readPAC(t, Header{}); status != "HTTP/1.1 500 internal error" {
+		t.Error("should reply 500 if template fails, got", status)
+	}
+	if tmpl, _ := getPACTemplate(); tmpl != pac.builtinTemplate {
+		t.Error("should fall back to builtin template if user template fails")
+	}
+	if b, _, err := genPAC(c); err != nil || !strings.Contains(string(b), "FindProxyForURL") {
+		t.Error("builtin template should be used after user template fails:", err)
+	}
+}
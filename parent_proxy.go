@@ -1,18 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/shadowsocks/go-shadowsocks2/core"
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 	"hash/crc32"
 	"io"
-	"math/rand"
 	"net"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,6 +40,9 @@ type ParentPool interface {
 // parent proxies.
 var parentProxy ParentPool = &backupParentPool{}
 
+// Parent pools for parent proxy groups, used by route rules.
+var parentGroup = make(map[string]ParentPool)
+
 func initParentPool() {
 	backPool, ok := parentProxy.(*backupParentPool)
 	if !ok {
@@ -48,20 +55,62 @@ func initParentPool() {
 		info.Println("no parent proxy server")
 		return
 	}
-	if len(backPool.parent) == 1 && config.LoadBalance != loadBalanceBackup {
+
+	// Parent proxy without group is in the default pool.
+	defaultPool := &backupParentPool{}
+	groupPool := make(map[string]*backupParentPool)
+	for _, parent := range backPool.parent {
+		if len(parent.group) == 0 {
+			defaultPool.parent = append(defaultPool.parent, parent)
+		}
+		for _, name := range parent.group {
+			if name == routeDefault {
+				defaultPool.parent = append(defaultPool.parent, parent)
+				continue
+			}
+			if groupPool[name] == nil {
+				groupPool[name] = &backupParentPool{}
+			}
+			groupPool[name].parent = append(groupPool[name].parent, parent)
+		}
+	}
+
+	parentProxy = newParentPool(defaultPool)
+	for name, pool := range groupPool {
+		debug.Println("parent proxy group", name)
+		parentGroup[name] = newParentPool(pool)
+	}
+	if config.HealthCheckInterval > 0 {
+		go runHealthCheck(backPool.parent)
+	}
+}
+
+// newParentPool creates parent pool using the configured load balance
+// strategy.
+func newParentPool(backPool *backupParentPool) ParentPool {
+	loadBalance := config.LoadBalance
+	if len(backPool.parent) <= 1 && loadBalance != loadBalanceBackup {
 		debug.Println("only 1 parent, no need for load balance")
-		config.LoadBalance = loadBalanceBackup
+		loadBalance = loadBalanceBackup
 	}
 
-	switch config.LoadBalance {
+	switch loadBalance {
 	case loadBalanceHash:
 		debug.Println("hash parent pool", len(backPool.parent))
-		parentProxy = &hashParentPool{*backPool}
+		return &hashParentPool{*backPool}
 	case loadBalanceLatency:
 		debug.Println("latency parent pool", len(backPool.parent))
-		go updateParentProxyLatency()
-		parentProxy = newLatencyParentPool(backPool.parent)
+		pool := newLatencyParentPool(backPool.parent)
+		go updateParentProxyLatency(pool)
+		return pool
+	case loadBalanceWeighted:
+		debug.Println("weighted parent pool", len(backPool.parent))
+		return newWeightedParentPool(backPool.parent)
+	case loadBalanceLeastConn:
+		debug.Println("least connection parent pool", len(backPool.parent))
+		return newLeastConnParentPool(backPool.parent)
 	}
+	return backPool
 }
 
 func printParentProxy(parent []ParentWithFail) {
@@ -71,18 +120,22 @@ func printParentProxy(parent []ParentWithFail) {
 		case *shadowsocksParent:
 			debug.Println("\tshadowsocks: ", pc.server)
 		case *httpParent:
-			debug.Println("\thttp parent: ", pc.server)
+			debug.Printf("\t%s parent: %s\n", pc.scheme(), pc.server)
 		case *socksParent:
 			debug.Println("\tsocks parent: ", pc.server)
 		case *cowParent:
 			debug.Println("\tcow parent: ", pc.server)
+		case *sshParent:
+			debug.Println("\tssh parent: ", pc.server, pc.state())
 		}
 	}
 }
 
 type ParentWithFail struct {
 	ParentProxy
-	fail int
+	health *parentHealth
+	weight int      // used by weighted and least connection pool
+	group  []string // parent proxy groups, empty for default pool only
 }
 
 // Backup load balance strategy:
@@ -96,7 +149,7 @@ func (pp *backupParentPool) empty() bool {
 }
 
 func (pp *backupParentPool) add(parent ParentProxy) {
-	pp.parent = append(pp.parent, ParentWithFail{parent, 0})
+	pp.parent = append(pp.parent, ParentWithFail{parent, newParentHealth(parent.getServer()), 1, nil})
 }
 
 func (pp *backupParentPool) connect(url *URL) (srvconn net.Conn, err error) {
@@ -116,50 +169,340 @@ func (pp *hashParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 }
 
 func (parent *ParentWithFail) connect(url *URL) (srvconn net.Conn, err error) {
-	const maxFailCnt = 30
-	srvconn, err = parent.ParentProxy.connect(url)
-	if err != nil {
-		if parent.fail < maxFailCnt && !networkBad() {
-			parent.fail++
-		}
-		return
-	}
-	parent.fail = 0
-	return
+	return connectParent(parent.ParentProxy, parent.health, url)
 }
 
 func connectInOrder(url *URL, pp []ParentWithFail, start int) (srvconn net.Conn, err error) {
-	const baseFailCnt = 9
-	var skipped []int
 	nproxy := len(pp)
 
 	if nproxy == 0 {
 		return nil, errors.New("no parent proxy")
 	}
 
+	err = errAllParentDown
 	for i := 0; i < nproxy; i++ {
-		proxyId := (start + i) % nproxy
-		parent := &pp[proxyId]
-		// skip failed server, but try it with some probability
-		if parent.fail > 0 && rand.Intn(parent.fail+baseFailCnt) != 0 {
-			skipped = append(skipped, proxyId)
+		parent := &pp[(start+i)%nproxy]
+		// skip down server
+		if !parent.health.allow() {
 			continue
 		}
 		if srvconn, err = parent.connect(url); err == nil {
 			return
 		}
 	}
-	// last resort, try skipped one, not likely to succeed
-	for _, skippedId := range skipped {
-		if srvconn, err = pp[skippedId].connect(url); err == nil {
+	if err == errAllParentDown {
+		id := lastResortParent(nproxy, func(i int) *parentHealth { return pp[i].health })
+		return pp[id].connect(url)
+	}
+	return nil, err
+}
+
+// connectSelected tries parent proxies returned by selectParent until one
+// succeeds. selectParent should return -1 if there's no more usable parent.
+func connectSelected(url *URL, pp []ParentWithFail, selectParent func(tried []bool) int) (srvconn net.Conn, id int, err error) {
+	if len(pp) == 0 {
+		return nil, -1, errors.New("no parent proxy")
+	}
+
+	tried := make([]bool, len(pp))
+	err = errAllParentDown
+	for {
+		if id = selectParent(tried); id == -1 {
+			if err == errAllParentDown {
+				id = lastResortParent(len(pp), func(i int) *parentHealth { return pp[i].health })
+				srvconn, err = pp[id].connect(url)
+				return
+			}
+			return nil, -1, err
+		}
+		tried[id] = true
+		parent := &pp[id]
+		// health may change after selection
+		if !parent.health.allow() {
+			continue
+		}
+		if srvconn, err = parent.connect(url); err == nil {
 			return
 		}
 	}
-	return nil, err
+}
+
+// Weighted round-robin load balance strategy:
+// Select proxy using smooth weighted round-robin, the same as nginx. Parent
+// proxy with weight 2 is selected twice as often as one with weight 1, and
+// selections are interleaved instead of in bursts.
+type weightedParentPool struct {
+	backupParentPool
+	mu      sync.Mutex
+	current []int // current weight for each parent
+}
+
+func newWeightedParentPool(parent []ParentWithFail) *weightedParentPool {
+	return &weightedParentPool{
+		backupParentPool: backupParentPool{parent},
+		current:          make([]int, len(parent)),
+	}
+}
+
+func (pp *weightedParentPool) add(parent ParentProxy) {
+	pp.mu.Lock()
+	pp.backupParentPool.add(parent)
+	pp.current = append(pp.current, 0)
+	pp.mu.Unlock()
+}
+
+func (pp *weightedParentPool) selectParent(tried []bool) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	best := -1
+	total := 0
+	for i := range pp.parent {
+		parent := &pp.parent[i]
+		if tried[i] || !parent.health.usable() {
+			continue
+		}
+		pp.current[i] += parent.weight
+		total += parent.weight
+		if best == -1 || pp.current[i] > pp.current[best] {
+			best = i
+		}
+	}
+	if best != -1 {
+		pp.current[best] -= total
+	}
+	return best
+}
+
+func (pp *weightedParentPool) connect(url *URL) (srvconn net.Conn, err error) {
+	srvconn, _, err = connectSelected(url, pp.parent, pp.selectParent)
+	return
+}
+
+// Least connection load balance strategy:
+// Select proxy with least active connections relative to its weight.
+type leastConnParentPool struct {
+	backupParentPool
+	active []int32 // active connections for each parent
+}
+
+func newLeastConnParentPool(parent []ParentWithFail) *leastConnParentPool {
+	return &leastConnParentPool{
+		backupParentPool: backupParentPool{parent},
+		active:           make([]int32, len(parent)),
+	}
+}
+
+func (pp *leastConnParentPool) add(parent ParentProxy) {
+	pp.backupParentPool.add(parent)
+	pp.active = append(pp.active, 0)
+}
+
+func (pp *leastConnParentPool) selectParent(tried []bool) int {
+	best := -1
+	var bestActive int32
+	for i := range pp.parent {
+		if tried[i] || !pp.parent[i].health.usable() {
+			continue
+		}
+		active := atomic.LoadInt32(&pp.active[i])
+		// Compare active/weight without division.
+		if best == -1 || int64(active)*int64(pp.parent[best].weight) <
+			int64(bestActive)*int64(pp.parent[i].weight) {
+			best = i
+			bestActive = active
+		}
+	}
+	return best
+}
+
+func (pp *leastConnParentPool) connect(url *URL) (srvconn net.Conn, err error) {
+	srvconn, id, err := connectSelected(url, pp.parent, pp.selectParent)
+	if err != nil {
+		return nil, err
+	}
+	active := &pp.active[id]
+	atomic.AddInt32(active, 1)
+	return trackConnClose(srvconn, func() { atomic.AddInt32(active, -1) }), nil
+}
+
+// closeTrackConn calls onClose once when the connection is closed.
+type closeTrackConn struct {
+	net.Conn
+	once    *sync.Once
+	onClose func()
+}
+
+func (c closeTrackConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// trackConnClose makes onClose called when srvconn is closed.
+func trackConnClose(srvconn net.Conn, onClose func()) net.Conn {
+	return replaceInnerConn(srvconn, func(c net.Conn) net.Conn {
+		return closeTrackConn{c, new(sync.Once), onClose}
+	})
+}
+
+// replaceInnerConn replaces the connection inside direct or parent
+// connection with wrap's return value, as other code checks connection type.
+func replaceInnerConn(srvconn net.Conn, wrap func(net.Conn) net.Conn) net.Conn {
+	switch pc := srvconn.(type) {
+	case directConn:
+		pc.Conn = wrap(pc.Conn)
+		return pc
+	case httpConn:
+		pc.Conn = wrap(pc.Conn)
+		return pc
+	case cowConn:
+		pc.Conn = wrap(pc.Conn)
+		return pc
+	case shadowsocksConn:
+		pc.Conn = wrap(pc.Conn)
+		return pc
+	case socksConn:
+		pc.Conn = wrap(pc.Conn)
+		return pc
+	case sshConn:
+		pc.Conn = wrap(pc.Conn)
+		return pc
+	}
+	return wrap(srvconn)
+}
+
+const (
+	// Weight of new sample in exponentially weighted moving average.
+	latencyEWMAAlpha = 0.3
+	// Larger time to first byte is likely caused by the server instead of
+	// parent proxy, e.g. long polling. Ignore such samples.
+	latencyMaxSample = 30 * time.Second
+	// Interval to update latency ranking.
+	latencyRankInterval = 10 * time.Second
+	// Probe parent proxy if there's no sample from real traffic in this
+	// period.
+	latencyProbeInterval = time.Minute
+)
+
+// latencyStat keeps exponentially weighted moving average of time to first
+// byte of real requests through a parent proxy. Probe measures connecting
+// to target instead, so it's kept in its own average, which is only used if
+// there's no recent sample from real requests.
+type latencyStat struct {
+	sync.Mutex
+	ewma    time.Duration
+	samples int
+	update  time.Time
+
+	probeEWMA    time.Duration
+	probeSamples int
+	probeUpdate  time.Time
+	failed       bool // last probe failed
+}
+
+// Latency stat for parent proxies in latency pool, used to find stat for
+// server connection. Not modified after parent pool initialization.
+var latencyStats = make(map[ParentProxy]*latencyStat)
+
+func addEWMA(ewma *time.Duration, samples *int, d time.Duration) {
+	if *samples == 0 {
+		*ewma = d
+	} else {
+		*ewma = time.Duration(latencyEWMAAlpha*float64(d) +
+			(1-latencyEWMAAlpha)*float64(*ewma))
+	}
+	*samples++
+}
+
+// add records time to first byte of a real request.
+func (ls *latencyStat) add(d time.Duration) {
+	if d > latencyMaxSample {
+		return
+	}
+	ls.Lock()
+	addEWMA(&ls.ewma, &ls.samples, d)
+	ls.update = time.Now()
+	ls.failed = false
+	ls.Unlock()
+}
+
+// addProbe records time taken by a successful probe.
+func (ls *latencyStat) addProbe(d time.Duration) {
+	ls.Lock()
+	addEWMA(&ls.probeEWMA, &ls.probeSamples, d)
+	ls.probeUpdate = time.Now()
+	ls.failed = false
+	ls.Unlock()
+}
+
+func (ls *latencyStat) probeFailed() {
+	ls.Lock()
+	ls.probeUpdate = time.Now()
+	ls.failed = true
+	ls.Unlock()
+}
+
+// latency returns average time to first byte if there's recent sample from
+// real requests, otherwise probe average is used. Returns latencyMax if
+// there's no sample or last probe failed.
+func (ls *latencyStat) latency() time.Duration {
+	ls.Lock()
+	defer ls.Unlock()
+	switch {
+	case ls.failed:
+		return latencyMax
+	case ls.samples > 0 && (ls.probeSamples == 0 ||
+		time.Now().Sub(ls.update) < latencyProbeInterval):
+		return ls.ewma
+	case ls.probeSamples > 0:
+		return ls.probeEWMA
+	}
+	return latencyMax
+}
+
+// lastUpdate returns time of the last sample or probe.
+func (ls *latencyStat) lastUpdate() time.Time {
+	ls.Lock()
+	defer ls.Unlock()
+	if ls.probeUpdate.After(ls.update) {
+		return ls.probeUpdate
+	}
+	return ls.update
+}
+
+// parentOfConn returns the parent proxy of a connection, nil if it's not
+// connected through parent proxy.
+func parentOfConn(c net.Conn) ParentProxy {
+	switch pc := c.(type) {
+	case httpConn:
+		return pc.parent
+	case cowConn:
+		return pc.parent
+	case shadowsocksConn:
+		return pc.parent
+	case socksConn:
+		return pc.parent
+	case sshConn:
+		return pc.parent
+	}
+	return nil
+}
+
+// updateConnLatency records time to first byte since start for connection
+// through parent proxy in latency pool.
+func updateConnLatency(c net.Conn, start time.Time) {
+	parent := parentOfConn(c)
+	if parent == nil {
+		return
+	}
+	if ls, ok := latencyStats[parent]; ok {
+		ls.add(time.Now().Sub(start))
+	}
 }
 
 type ParentWithLatency struct {
 	ParentProxy
+	health  *parentHealth
+	stat    *latencyStat
 	latency time.Duration
 }
 
@@ -170,7 +513,8 @@ type latencyParentPool struct {
 func newLatencyParentPool(parent []ParentWithFail) *latencyParentPool {
 	lp := &latencyParentPool{}
 	for _, p := range parent {
-		lp.add(p.ParentProxy)
+		// Share health with the backup pool, which is used by health check.
+		lp.addWithHealth(p.ParentProxy, p.health)
 	}
 	return lp
 }
@@ -180,7 +524,17 @@ func (pp *latencyParentPool) empty() bool {
 }
 
 func (pp *latencyParentPool) add(parent ParentProxy) {
-	pp.parent = append(pp.parent, ParentWithLatency{parent, 0})
+	pp.addWithHealth(parent, newParentHealth(parent.getServer()))
+}
+
+func (pp *latencyParentPool) addWithHealth(parent ParentProxy, health *parentHealth) {
+	// Parent proxy may be in multiple groups.
+	stat, ok := latencyStats[parent]
+	if !ok {
+		stat = &latencyStat{}
+		latencyStats[parent] = stat
+	}
+	pp.parent = append(pp.parent, ParentWithLatency{parent, health, stat, latencyMax})
 }
 
 // Sort interface.
@@ -215,12 +569,16 @@ func (pp *latencyParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 		return nil, errors.New("no parent proxy")
 	}
 
+	err = errAllParentDown
 	for i := 0; i < nproxy; i++ {
 		parent := lp[i]
 		if parent.latency >= latencyMax {
 			skipped = append(skipped, i)
 			continue
 		}
+		if !parent.health.allow() {
+			continue
+		}
 		if srvconn, err = parent.connect(url); err == nil {
 			debug.Println("lowest latency proxy", parent.getServer())
 			return
@@ -229,61 +587,57 @@ func (pp *latencyParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 	}
 	// last resort, try skipped one, not likely to succeed
 	for _, skippedId := range skipped {
-		if srvconn, err = lp[skippedId].connect(url); err == nil {
+		parent := &lp[skippedId]
+		if !parent.health.allow() {
+			continue
+		}
+		if srvconn, err = parent.connect(url); err == nil {
 			return
 		}
 	}
+	if err == errAllParentDown {
+		id := lastResortParent(nproxy, func(i int) *parentHealth { return lp[i].health })
+		return lp[id].connect(url)
+	}
 	return nil, err
 }
 
+func (parent *ParentWithLatency) connect(url *URL) (net.Conn, error) {
+	return connectParent(parent.ParentProxy, parent.health, url)
+}
+
+// updateLatency probes the parent proxy if there's no recent sample from real
+// traffic, then updates latency from latency stat.
 func (parent *ParentWithLatency) updateLatency(wg *sync.WaitGroup) {
 	defer wg.Done()
-	proxy := parent.ParentProxy
-	server := proxy.getServer()
-
-	host, port, err := net.SplitHostPort(server)
-	if err != nil {
-		panic("split host port parent server error" + err.Error())
-	}
-
-	// Resolve host name first, so latency does not include resolve time.
-	ip, err := net.LookupHost(host)
-	if err != nil {
-		parent.latency = latencyMax
-		return
-	}
-	ipPort := net.JoinHostPort(ip[0], port)
-
-	const N = 3
-	var total time.Duration
-	for i := 0; i < N; i++ {
-		now := time.Now()
-		cn, err := net.DialTimeout("tcp", ipPort, dialTimeout)
-		if err != nil {
-			debug.Println("latency update dial:", err)
-			total += time.Minute // 1 minute as penalty
-			continue
+	server := parent.getServer()
+
+	if time.Now().Sub(parent.stat.lastUpdate()) >= latencyProbeInterval {
+		start := time.Now()
+		if err := probeParent(parent.ParentProxy, config.HealthCheckTarget); err != nil {
+			debug.Println("latency probe", server, err)
+			parent.stat.probeFailed()
+		} else {
+			parent.stat.addProbe(time.Now().Sub(start))
 		}
-		total += time.Now().Sub(now)
-		cn.Close()
-
-		time.Sleep(5 * time.Millisecond)
 	}
-	parent.latency = total / N
+	parent.latency = parent.stat.latency()
 	debug.Println("latency", server, parent.latency)
 }
 
 func (pp *latencyParentPool) updateLatency() {
 	// Create a copy, update latency for the copy.
 	var cp latencyParentPool
+	latencyMutex.RLock()
 	cp.parent = append(cp.parent, pp.parent...)
+	latencyMutex.RUnlock()
 
 	// cp.parent is value instead of pointer, if we use `_, p := range cp.parent`,
 	// the value in cp.parent will not be updated.
 	var wg sync.WaitGroup
 	wg.Add(len(cp.parent))
-	for i, _ := range cp.parent {
-		cp.parent[i].updateLatency(&wg)
+	for i := range cp.parent {
+		go cp.parent[i].updateLatency(&wg)
 	}
 	wg.Wait()
 
@@ -297,23 +651,49 @@ func (pp *latencyParentPool) updateLatency() {
 	latencyMutex.Unlock()
 }
 
-func updateParentProxyLatency() {
-	lp, ok := parentProxy.(*latencyParentPool)
-	if !ok {
-		return
+// ranking returns current latency ranking of parent proxies, one per line.
+func (pp *latencyParentPool) ranking() string {
+	latencyMutex.RLock()
+	lp := pp.parent
+	latencyMutex.RUnlock()
+
+	buf := new(bytes.Buffer)
+	for i, parent := range lp {
+		parent.stat.Lock()
+		ewma, samples, probeEWMA, probes := parent.stat.ewma, parent.stat.samples,
+			parent.stat.probeEWMA, parent.stat.probeSamples
+		parent.stat.Unlock()
+		update := parent.stat.lastUpdate()
+
+		latency := "unknown"
+		if parent.latency < latencyMax {
+			latency = parent.latency.String()
+		}
+		fmt.Fprintf(buf, "%d %s latency %s ewma %v samples %d probe %v probes %d", i+1,
+			parent.getServer(), latency, ewma, samples, probeEWMA, probes)
+		if !update.IsZero() {
+			fmt.Fprintf(buf, " updated %v ago", time.Now().Sub(update)/time.Second*time.Second)
+		}
+		fmt.Fprintf(buf, " %s\n", parent.health.getState())
 	}
+	return buf.String()
+}
 
+func updateParentProxyLatency(lp *latencyParentPool) {
 	for {
 		lp.updateLatency()
-		time.Sleep(60 * time.Second)
+		time.Sleep(latencyRankInterval)
 	}
 }
 
-// http parent proxy
+// http parent proxy, also used for https parent proxy (http proxy over TLS)
 type httpParent struct {
 	server     string
 	userPasswd string // for upgrade config
 	authHeader []byte
+
+	tlsConfig *tls.Config // not nil for https parent
+	tlsOpts   string      // for upgrade config
 }
 
 type httpConn struct {
@@ -322,7 +702,7 @@ type httpConn struct {
 }
 
 func (s httpConn) String() string {
-	return "http parent proxy " + s.parent.server
+	return s.parent.scheme() + " parent proxy " + s.parent.server
 }
 
 func newHttpParent(server string) *httpParent {
@@ -333,12 +713,45 @@ func (hp *httpParent) getServer() string {
 	return hp.server
 }
 
+func (hp *httpParent) scheme() string {
+	if hp.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
 func (hp *httpParent) genConfig() string {
+	var cfg string
 	if hp.userPasswd != "" {
-		return fmt.Sprintf("proxy = http://%s@%s", hp.userPasswd, hp.server)
+		cfg = fmt.Sprintf("proxy = %s://%s@%s", hp.scheme(), hp.userPasswd, hp.server)
 	} else {
-		return fmt.Sprintf("proxy = http://%s", hp.server)
+		cfg = fmt.Sprintf("proxy = %s://%s", hp.scheme(), hp.server)
+	}
+	if hp.tlsOpts != "" {
+		cfg += " " + hp.tlsOpts
 	}
+	return cfg
+}
+
+// initTLS makes hp an https parent. serverName defaults to host in server
+// address. System CA is used if caFile is empty.
+func (hp *httpParent) initTLS(serverName, caFile string, skipVerify bool) error {
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(hp.server)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	hp.tlsConfig = tlsConfig
+	return nil
 }
 
 func (hp *httpParent) initAuth(userPasswd string) {
@@ -353,21 +766,75 @@ func (hp *httpParent) initAuth(userPasswd string) {
 func (hp *httpParent) connect(url *URL) (net.Conn, error) {
 	c, err := net.Dial("tcp", hp.server)
 	if err != nil {
-		errl.Printf("can't connect to http parent %s for %s: %v\n",
-			hp.server, url.HostPort, err)
+		errl.Printf("can't connect to %s parent %s for %s: %v\n",
+			hp.scheme(), hp.server, url.HostPort, err)
 		return nil, err
 	}
-	debug.Printf("connected to: %s via http parent: %s\n",
-		url.HostPort, hp.server)
+	if hp.tlsConfig != nil {
+		tc := tls.Client(c, hp.tlsConfig)
+		c.SetDeadline(time.Now().Add(dialTimeout))
+		if err = tc.Handshake(); err != nil {
+			errl.Printf("https parent %s TLS handshake for %s: %v\n",
+				hp.server, url.HostPort, err)
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(zeroTime)
+		c = tc
+	}
+	debug.Printf("connected to: %s via %s parent: %s\n",
+		url.HostPort, hp.scheme(), hp.server)
 	return httpConn{c, hp}, nil
 }
 
+// AEAD encrypt methods, which are provided by go-shadowsocks2. Other methods
+// are stream ciphers provided by shadowsocks-go.
+var aeadMethod = map[string]bool{
+	"chacha20-ietf-poly1305": true,
+	"aes-256-gcm":            true,
+	"aes-128-gcm":            true,
+}
+
+func isAEADMethod(method string) bool {
+	return aeadMethod[strings.ToLower(method)]
+}
+
+// ssCipher is used by both shadowsocks and cow proxy to encrypt connections.
+// Exactly one of stream and aead is set.
+type ssCipher struct {
+	stream *ss.Cipher
+	aead   core.Cipher
+}
+
+func newSsCipher(method, passwd string) (*ssCipher, error) {
+	if isAEADMethod(method) {
+		cipher, err := core.PickCipher(method, nil, passwd)
+		if err != nil {
+			return nil, err
+		}
+		return &ssCipher{aead: cipher}, nil
+	}
+	cipher, err := ss.NewCipher(method, passwd)
+	if err != nil {
+		return nil, err
+	}
+	return &ssCipher{stream: cipher}, nil
+}
+
+// conn returns a connection which encrypts all data sent through c.
+func (cipher *ssCipher) conn(c net.Conn) net.Conn {
+	if cipher.aead != nil {
+		return cipher.aead.StreamConn(c)
+	}
+	return ss.NewConn(c, cipher.stream.Copy())
+}
+
 // shadowsocks parent proxy
 type shadowsocksParent struct {
 	server string
 	method string // method and passwd are for upgrade config
 	passwd string
-	cipher *ss.Cipher
+	cipher *ssCipher
 }
 
 type shadowsocksConn struct {
@@ -396,21 +863,52 @@ func (sp *shadowsocksParent) genConfig() string {
 	if method == "" {
 		method = "table"
 	}
+	if isAEADMethod(method) {
+		// Use SIP002 URI for AEAD methods, which is supported by most
+		// shadowsocks clients.
+		userInfo := base64.RawURLEncoding.EncodeToString([]byte(method + ":" + sp.passwd))
+		return fmt.Sprintf("proxy = ss://%s@%s", userInfo, sp.server)
+	}
 	return fmt.Sprintf("proxy = ss://%s:%s@%s", method, sp.passwd, sp.server)
 }
 
 func (sp *shadowsocksParent) initCipher(method, passwd string) {
 	sp.method = method
 	sp.passwd = passwd
-	cipher, err := ss.NewCipher(method, passwd)
+	cipher, err := newSsCipher(method, passwd)
 	if err != nil {
 		Fatal("create shadowsocks cipher:", err)
 	}
 	sp.cipher = cipher
 }
 
+func (sp *shadowsocksParent) dial(hostPort string) (net.Conn, error) {
+	if sp.cipher.aead == nil {
+		c, err := ss.Dial(hostPort, sp.server, sp.cipher.stream.Copy())
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	rawaddr, err := ss.RawAddr(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("tcp", sp.server)
+	if err != nil {
+		return nil, err
+	}
+	c = sp.cipher.conn(c)
+	// Target address is sent as the beginning of the payload.
+	if _, err = c.Write(rawaddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
 func (sp *shadowsocksParent) connect(url *URL) (net.Conn, error) {
-	c, err := ss.Dial(url.HostPort, sp.server, sp.cipher.Copy())
+	c, err := sp.dial(url.HostPort)
 	if err != nil {
 		errl.Printf("can't connect to shadowsocks parent %s for %s: %v\n",
 			sp.server, url.HostPort, err)
@@ -425,7 +923,8 @@ type cowParent struct {
 	server string
 	method string
 	passwd string
-	cipher *ss.Cipher
+	cipher *ssCipher
+	mux    *muxClient // nil if not using multiplexing
 }
 
 type cowConn struct {
@@ -438,11 +937,17 @@ func (s cowConn) String() string {
 }
 
 func newCowParent(srv, method, passwd string) *cowParent {
-	cipher, err := ss.NewCipher(method, passwd)
+	cipher, err := newSsCipher(method, passwd)
 	if err != nil {
 		Fatal("create cow cipher:", err)
 	}
-	return &cowParent{srv, method, passwd, cipher}
+	return &cowParent{server: srv, method: method, passwd: passwd, cipher: cipher}
+}
+
+// initMux makes cow parent carry requests as streams over at most n long
+// lived connections.
+func (cp *cowParent) initMux(n int) {
+	cp.mux = newMuxClient(n, cp.dialMux)
 }
 
 func (cp *cowParent) getServer() string {
@@ -454,10 +959,43 @@ func (cp *cowParent) genConfig() string {
 	if method == "" {
 		method = "table"
 	}
-	return fmt.Sprintf("proxy = cow://%s:%s@%s", method, cp.passwd, cp.server)
+	s := fmt.Sprintf("proxy = cow://%s:%s@%s", method, cp.passwd, cp.server)
+	if cp.mux != nil {
+		s += fmt.Sprintf(" mux=%d", len(cp.mux.session))
+	}
+	return s
+}
+
+func (cp *cowParent) dialMux() (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", cp.server, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(time.Minute)
+	}
+	c = cp.cipher.conn(c)
+	if _, err = c.Write(muxMagic); err != nil {
+		c.Close()
+		return nil, err
+	}
+	debug.Println("created mux session to cow parent:", cp.server)
+	return c, nil
 }
 
 func (cp *cowParent) connect(url *URL) (net.Conn, error) {
+	if cp.mux != nil {
+		st, err := cp.mux.open()
+		if err != nil {
+			errl.Printf("can't open stream to cow parent %s for %s: %v\n",
+				cp.server, url.HostPort, err)
+			return nil, err
+		}
+		debug.Printf("connected to: %s via cow parent: %s %s\n",
+			url.HostPort, cp.server, st)
+		return cowConn{st, cp}, nil
+	}
 	c, err := net.Dial("tcp", cp.server)
 	if err != nil {
 		errl.Printf("can't connect to cow parent %s for %s: %v\n",
@@ -466,8 +1004,7 @@ func (cp *cowParent) connect(url *URL) (net.Conn, error) {
 	}
 	debug.Printf("connected to: %s via cow parent: %s\n",
 		url.HostPort, cp.server)
-	ssconn := ss.NewConn(c, cp.cipher.Copy())
-	return cowConn{ssconn, cp}, nil
+	return cowConn{cp.cipher.conn(c), cp}, nil
 }
 
 // For socks documentation, refer to rfc 1928 http://www.ietf.org/rfc/rfc1928.txt
@@ -492,9 +1029,18 @@ var socksMsgVerMethodSelection = []byte{
 	0,   // no authorization required
 }
 
+var socksMsgVerMethodSelectionAuth = []byte{
+	0x5, // version 5
+	2,   // n method
+	0,   // no authorization required
+	2,   // username/password
+}
+
 // socks5 parent proxy
 type socksParent struct {
 	server string
+	user   string // username/password authentication, refer to rfc 1929
+	passwd string
 }
 
 type socksConn struct {
@@ -507,7 +1053,7 @@ func (s socksConn) String() string {
 }
 
 func newSocksParent(server string) *socksParent {
-	return &socksParent{server}
+	return &socksParent{server: server}
 }
 
 func (sp *socksParent) getServer() string {
@@ -515,9 +1061,42 @@ func (sp *socksParent) getServer() string {
 }
 
 func (sp *socksParent) genConfig() string {
+	if sp.user != "" {
+		return fmt.Sprintf("proxy = socks5://%s:%s@%s", sp.user, sp.passwd, sp.server)
+	}
 	return fmt.Sprintf("proxy = socks5://%s", sp.server)
 }
 
+func (sp *socksParent) initAuth(user, passwd string) {
+	sp.user = user
+	sp.passwd = passwd
+}
+
+// authUserPasswd does username/password authentication after the server
+// selects the method.
+func (sp *socksParent) authUserPasswd(c net.Conn) error {
+	req := make([]byte, 0, 3+len(sp.user)+len(sp.passwd))
+	req = append(req, socksUserPasswdVer, byte(len(sp.user)))
+	req = append(req, sp.user...)
+	req = append(req, byte(len(sp.passwd)))
+	req = append(req, sp.passwd...)
+	if _, err := c.Write(req); err != nil {
+		errl.Printf("sending socks username/password to %s %v\n", sp.server, err)
+		return err
+	}
+	rep := make([]byte, 2)
+	if _, err := io.ReadFull(c, rep); err != nil {
+		errl.Printf("read socks username/password reply from %s %v\n", sp.server, err)
+		return err
+	}
+	if rep[1] != 0 {
+		errl.Printf("socks parent %s authentication failed, status %d\n", sp.server, rep[1])
+		return fmt.Errorf("socks parent proxy %s authentication failed, "+
+			"please check username and password", sp.server)
+	}
+	return nil
+}
+
 func (sp *socksParent) connect(url *URL) (net.Conn, error) {
 	c, err := net.Dial("tcp", sp.server)
 	if err != nil {
@@ -533,7 +1112,11 @@ func (sp *socksParent) connect(url *URL) (net.Conn, error) {
 	}()
 
 	var n int
-	if n, err = c.Write(socksMsgVerMethodSelection); n != 3 || err != nil {
+	msg := socksMsgVerMethodSelection
+	if sp.user != "" {
+		msg = socksMsgVerMethodSelectionAuth
+	}
+	if n, err = c.Write(msg); n != len(msg) || err != nil {
 		errl.Printf("sending ver/method selection msg %v n = %v\n", err, n)
 		hasErr = true
 		return nil, err
@@ -547,11 +1130,28 @@ func (sp *socksParent) connect(url *URL) (net.Conn, error) {
 		hasErr = true
 		return nil, err
 	}
-	if repBuf[0] != 5 || repBuf[1] != 0 {
+	switch {
+	case repBuf[0] != 5:
 		errl.Printf("socks ver/method selection reply error ver %d method %d",
 			repBuf[0], repBuf[1])
 		hasErr = true
-		return nil, err
+		return nil, socksProtocolErr
+	case repBuf[1] == socksMethodNoAuth:
+	case repBuf[1] == socksMethodUserPasswd && sp.user != "":
+		if err = sp.authUserPasswd(c); err != nil {
+			hasErr = true
+			return nil, err
+		}
+	case repBuf[1] == socksMethodNoAcceptable:
+		errl.Printf("socks parent %s has no acceptable authentication method\n", sp.server)
+		hasErr = true
+		return nil, fmt.Errorf("socks parent proxy %s requires authentication "+
+			"not provided in config", sp.server)
+	default:
+		errl.Printf("socks ver/method selection reply error ver %d method %d",
+			repBuf[0], repBuf[1])
+		hasErr = true
+		return nil, socksProtocolErr
 	}
 	// debug.Println("Socks version selection done")
 
@@ -586,11 +1186,12 @@ func (sp *socksParent) connect(url *URL) (net.Conn, error) {
 	replyBuf := make([]byte, 10)
 	if n, err = c.Read(replyBuf); err != nil {
 		// Seems that socks server will close connection if it can't find host
+		hasErr = true
 		if err != io.EOF {
 			errl.Printf("read socks reply err %v n %d\n", err, n)
+			return nil, err
 		}
-		hasErr = true
-		return nil, errors.New("connection failed (by socks server " + sp.server + "). No such host?")
+		return nil, targetError{errors.New("connection failed (by socks server " + sp.server + "). No such host?")}
 	}
 	// debug.Printf("Socks reply length %d\n", n)
 
@@ -602,7 +1203,8 @@ func (sp *socksParent) connect(url *URL) (net.Conn, error) {
 	if replyBuf[1] != 0 {
 		errl.Printf("socks reply connect %s error %s\n", url.HostPort, socksError[replyBuf[1]])
 		hasErr = true
-		return nil, socksProtocolErr
+		// Socks server is working, connection to the target failed.
+		return nil, targetError{socksProtocolErr}
 	}
 	if replyBuf[3] != 1 {
 		errl.Printf("socks reply connect %s ATYP %d\n", url.HostPort, replyBuf[3])
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// aeadReader decrypts chacha20-ietf-poly1305 shadowsocks stream. It's
+// implemented here because go-shadowsocks2 rejects salt generated in the
+// same process, making it impossible to use it on both ends in test.
+type aeadReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newAEADReader(r io.Reader, passwd string) (*aeadReader, error) {
+	// Key derivation is the same as OpenSSL EVP_BytesToKey.
+	var key, prev []byte
+	for len(key) < chacha20poly1305.KeySize {
+		h := md5.Sum(append(prev, passwd...))
+		prev = h[:]
+		key = append(key, prev...)
+	}
+	salt := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, err
+	}
+	subkey := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha1.New, key[:chacha20poly1305.KeySize], salt, []byte("ss-subkey"))
+	if _, err := io.ReadFull(kdf, subkey); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadReader{r, aead, make([]byte, aead.NonceSize())}, nil
+}
+
+func (ar *aeadReader) open(n int) ([]byte, error) {
+	buf := make([]byte, n+ar.aead.Overhead())
+	if _, err := io.ReadFull(ar.r, buf); err != nil {
+		return nil, err
+	}
+	b, err := ar.aead.Open(buf[:0], ar.nonce, buf, nil)
+	for i := range ar.nonce {
+		ar.nonce[i]++
+		if ar.nonce[i] != 0 {
+			break
+		}
+	}
+	return b, err
+}
+
+func (ar *aeadReader) readChunk() ([]byte, error) {
+	b, err := ar.open(2)
+	if err != nil {
+		return nil, err
+	}
+	return ar.open(int(b[0])<<8 | int(b[1]))
+}
+
+func TestSsCipherAEAD(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	method, passwd := "chacha20-ietf-poly1305", "foobar"
+	if c, err := newSsCipher(method, passwd); err != nil || c.aead == nil {
+		t.Fatal(method, "should be AEAD cipher", err)
+	}
+
+	rawaddr := []byte{3, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80}
+	expected := append(rawaddr, "ping"...)
+	dataCh := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var data []byte
+			if ar, err := newAEADReader(conn, passwd); err == nil {
+				for len(data) < len(expected) {
+					b, err := ar.readChunk()
+					if err != nil {
+						data = nil
+						break
+					}
+					data = append(data, b...)
+				}
+			}
+			dataCh <- data
+			conn.Close()
+		}
+	}()
+
+	for _, pw := range []string{passwd, "wrong"} {
+		sp := newShadowsocksParent(ln.Addr().String())
+		sp.initCipher(method, pw)
+		c, err := sp.connect(&URL{HostPort: "example.com:80"})
+		if err != nil {
+			t.Fatal("connect shadowsocks parent:", err)
+		}
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal("write:", err)
+		}
+		data := <-dataCh
+		c.Close()
+		if pw == passwd && !bytes.Equal(data, expected) {
+			t.Errorf("shadowsocks parent should send %v, got %v\n", expected, data)
+		}
+		if pw != passwd && data != nil {
+			t.Error("data encrypted with wrong password should not be decrypted")
+		}
+	}
+}
+
+func TestShadowsocksParentGenConfig(t *testing.T) {
+	sp := newShadowsocksParent("1.2.3.4:8388")
+	sp.initCipher("aes-256-gcm", "foo:bar")
+	if sp.genConfig() != "proxy = ss://YWVzLTI1Ni1nY206Zm9vOmJhcg@1.2.3.4:8388" {
+		t.Error("AEAD shadowsocks genConfig should use SIP002, got:", sp.genConfig())
+	}
+
+	sp = newShadowsocksParent("1.2.3.4:8388")
+	sp.initCipher("aes-128-cfb", "foobar")
+	if sp.genConfig() != "proxy = ss://aes-128-cfb:foobar@1.2.3.4:8388" {
+		t.Error("stream shadowsocks genConfig wrong, got:", sp.genConfig())
+	}
+}
+
+func TestWeightedParentPool(t *testing.T) {
+	initConfig("")
+	parent := []*fakeParent{{server: "a:1"}, {server: "b:1"}, {server: "c:1"}}
+	var backPool backupParentPool
+	for _, p := range parent {
+		backPool.add(p)
+	}
+	backPool.parent[0].weight = 5
+	pool := newWeightedParentPool(backPool.parent)
+
+	// Return the name of parent used by connect.
+	url := &URL{HostPort: "example.com:80"}
+	connect := func() byte {
+		var cnt [3]int
+		for i, p := range parent {
+			cnt[i] = p.cnt
+		}
+		srvconn, err := pool.connect(url)
+		if err != nil {
+			t.Fatal("weighted pool connect:", err)
+		}
+		srvconn.Close()
+		for i, p := range parent {
+			if p.cnt != cnt[i] && !p.fail {
+				return p.server[0]
+			}
+		}
+		return '-'
+	}
+
+	// Smooth weighted round-robin sequence for weight 5, 1, 1.
+	var seq []byte
+	for i := 0; i < 7; i++ {
+		seq = append(seq, connect())
+	}
+	if string(seq) != "aabacaa" {
+		t.Error("weighted round-robin sequence wrong, got:", string(seq))
+	}
+
+	parent[0].fail = true
+	for i := 0; i < 20 && backPool.parent[0].health.getState() != circuitOpen; i++ {
+		connect()
+	}
+	if parent[0].cnt != 5+circuitFailThreshold {
+		t.Fatal("failed parent should be tried until marked down, tried",
+			parent[0].cnt-5)
+	}
+	cnt := map[byte]int{}
+	for i := 0; i < 10; i++ {
+		cnt[connect()]++
+	}
+	if parent[0].cnt != 5+circuitFailThreshold {
+		t.Error("down parent should be skipped")
+	}
+	if cnt['b'] < 4 || cnt['c'] < 4 {
+		t.Error("parents with same weight should be used evenly, got:", cnt)
+	}
+}
+
+func TestLeastConnParentPool(t *testing.T) {
+	initConfig("")
+	var backPool backupParentPool
+	backPool.add(&fakeParent{server: "a:1"})
+	backPool.add(&fakeParent{server: "b:1"})
+	backPool.parent[1].weight = 2
+	pool := newLeastConnParentPool(backPool.parent)
+
+	url := &URL{HostPort: "example.com:80"}
+	var conns []net.Conn
+	for i := 0; i < 6; i++ {
+		srvconn, err := pool.connect(url)
+		if err != nil {
+			t.Fatal("least connection pool connect:", err)
+		}
+		conns = append(conns, srvconn)
+	}
+	if pool.active[0] != 2 || pool.active[1] != 4 {
+		t.Errorf("active connections should be proportional to weight, got %v\n", pool.active)
+	}
+	for _, c := range conns[:3] {
+		c.Close()
+		c.Close() // close twice should only decrease active count once
+	}
+	if pool.active[0]+pool.active[1] != 3 {
+		t.Errorf("closed connections should not be active, got %v\n", pool.active)
+	}
+}
+
+func TestLatencyStat(t *testing.T) {
+	var ls latencyStat
+	if ls.latency() != latencyMax {
+		t.Error("latency without sample should be latencyMax")
+	}
+	ls.add(100 * time.Millisecond)
+	if ls.latency() != 100*time.Millisecond {
+		t.Error("first sample should be used as latency, got:", ls.latency())
+	}
+	ls.add(200 * time.Millisecond)
+	if ls.latency() != 130*time.Millisecond {
+		t.Error("latency should be moving average, got:", ls.latency())
+	}
+	ls.add(latencyMaxSample + time.Second)
+	if ls.samples != 2 {
+		t.Error("too large sample should be ignored")
+	}
+	ls.addProbe(time.Second)
+	if ls.latency() != 130*time.Millisecond {
+		t.Error("probe should not be used if there's recent sample, got:", ls.latency())
+	}
+	ls.update = time.Now().Add(-latencyProbeInterval)
+	if ls.latency() != time.Second {
+		t.Error("probe average should be used without recent sample, got:", ls.latency())
+	}
+	ls.probeFailed()
+	if ls.latency() != latencyMax {
+		t.Error("latency should be latencyMax after probe failure")
+	}
+}
+
+func TestLatencyParentPoolRanking(t *testing.T) {
+	var backPool backupParentPool
+	slow := newHttpParent("127.0.0.1:1")
+	fast := newHttpParent("127.0.0.1:2")
+	backPool.add(slow)
+	backPool.add(fast)
+	pool := newLatencyParentPool(backPool.parent)
+
+	// Recent samples from real traffic, so no probe is made.
+	start := time.Now().Add(-300 * time.Millisecond)
+	updateConnLatency(httpConn{nil, slow}, start)
+	updateConnLatency(httpConn{nil, fast}, start.Add(200*time.Millisecond))
+	pool.updateLatency()
+
+	if pool.parent[0].ParentProxy != fast {
+		t.Error("parent with lower latency should rank first")
+	}
+	ranking := strings.Split(pool.ranking(), "\n")
+	if len(ranking) != 3 || !strings.HasPrefix(ranking[0], "1 127.0.0.1:2 ") ||
+		!strings.HasPrefix(ranking[1], "2 127.0.0.1:1 ") {
+		t.Errorf("latency ranking wrong, got:\n%s", pool.ranking())
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -12,7 +13,6 @@ import (
 
 	"github.com/cyfdecyf/bufio"
 	"github.com/cyfdecyf/leakybuf"
-	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 )
 
 // As I'm using ReadSlice to read line, it's possible to get
@@ -90,6 +90,7 @@ type serverConn struct {
 	willCloseOn time.Time
 	siteInfo    *VisitCnt
 	visited     bool
+	routed      bool // created according to route rule, not shared by sites
 }
 
 type clientConn struct {
@@ -97,6 +98,8 @@ type clientConn struct {
 	bufRd    *bufio.Reader
 	buf      []byte // buffer for the buffered reader
 	proxy    Proxy
+
+	socksReplied bool // for socks client, whether reply to request is sent
 }
 
 var (
@@ -121,6 +124,9 @@ type httpProxy struct {
 	addr      string // listen address, contains port
 	port      string // for use when generating PAC
 	addrInPAC string // proxy server address to use in PAC
+
+	isTLS     bool        // https proxy
+	tlsConfig *tls.Config // initialized in checkConfig for https proxy
 }
 
 func newHttpProxy(addr, addrInPAC string) *httpProxy {
@@ -128,14 +134,27 @@ func newHttpProxy(addr, addrInPAC string) *httpProxy {
 	if err != nil {
 		panic("proxy addr" + err.Error())
 	}
-	return &httpProxy{addr, port, addrInPAC}
+	return &httpProxy{addr: addr, port: port, addrInPAC: addrInPAC}
+}
+
+func newHttpsProxy(addr, addrInPAC string) *httpProxy {
+	hp := newHttpProxy(addr, addrInPAC)
+	hp.isTLS = true
+	return hp
+}
+
+func (proxy *httpProxy) scheme() string {
+	if proxy.isTLS {
+		return "https"
+	}
+	return "http"
 }
 
 func (proxy *httpProxy) genConfig() string {
 	if proxy.addrInPAC != "" {
-		return fmt.Sprintf("listen = http://%s %s", proxy.addr, proxy.addrInPAC)
+		return fmt.Sprintf("listen = %s://%s %s", proxy.scheme(), proxy.addr, proxy.addrInPAC)
 	} else {
-		return fmt.Sprintf("listen = http://%s", proxy.addr)
+		return fmt.Sprintf("listen = %s://%s", proxy.scheme(), proxy.addr)
 	}
 }
 
@@ -149,9 +168,12 @@ func (hp *httpProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	}()
 	ln, err := net.Listen("tcp", hp.addr)
 	if err != nil {
-		fmt.Println("listen http failed:", err)
+		fmt.Printf("listen %s failed: %v\n", hp.scheme(), err)
 		return
 	}
+	if hp.isTLS {
+		ln = tls.NewListener(ln, hp.tlsConfig)
+	}
 	var exit bool
 	go func() {
 		<-quit
@@ -161,18 +183,18 @@ func (hp *httpProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	host, _, _ := net.SplitHostPort(hp.addr)
 	var pacURL string
 	if host == "" || host == "0.0.0.0" {
-		pacURL = fmt.Sprintf("http://<hostip>:%s/pac", hp.port)
+		pacURL = fmt.Sprintf("%s://<hostip>:%s/pac", hp.scheme(), hp.port)
 	} else if hp.addrInPAC == "" {
-		pacURL = fmt.Sprintf("http://%s/pac", hp.addr)
+		pacURL = fmt.Sprintf("%s://%s/pac", hp.scheme(), hp.addr)
 	} else {
-		pacURL = fmt.Sprintf("http://%s/pac", hp.addrInPAC)
+		pacURL = fmt.Sprintf("%s://%s/pac", hp.scheme(), hp.addrInPAC)
 	}
-	info.Printf("COW %s listen http %s, PAC url %s\n", version, hp.addr, pacURL)
+	info.Printf("COW %s listen %s %s, PAC url %s\n", version, hp.scheme(), hp.addr, pacURL)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil && !exit {
-			errl.Printf("http proxy(%s) accept %v\n", ln.Addr(), err)
+			errl.Printf("%s proxy(%s) accept %v\n", hp.scheme(), ln.Addr(), err)
 			if isErrTooManyOpenFd(err) {
 				connPool.CloseAll()
 			}
@@ -189,15 +211,56 @@ func (hp *httpProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	}
 }
 
+// loadListenTLSConfig creates TLS config for https proxy. If tlsClientCAFile
+// is given, client certificate signed by the CA is accepted as
+// authentication. Client certificate is required if there's no other
+// authentication method.
+func loadListenTLSConfig() *tls.Config {
+	if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+		Fatal("https proxy requires tlsCertFile and tlsKeyFile")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		Fatal("https proxy load certificate:", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.TLSClientCAFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(config.TLSClientCAFile); err != nil {
+			Fatal("https proxy load client CA:", err)
+		}
+		if config.UserPasswd == "" && config.UserPasswdFile == "" &&
+			config.AllowedClient == "" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return tlsConfig
+}
+
+func initListenTLS() {
+	var tlsConfig *tls.Config
+	for _, proxy := range listenProxy {
+		hp, ok := proxy.(*httpProxy)
+		if !ok || !hp.isTLS {
+			continue
+		}
+		if tlsConfig == nil {
+			tlsConfig = loadListenTLSConfig()
+		}
+		hp.tlsConfig = tlsConfig
+	}
+}
+
 type cowProxy struct {
 	addr   string
 	method string
 	passwd string
-	cipher *ss.Cipher
+	cipher *ssCipher
 }
 
 func newCowProxy(method, passwd, addr string) *cowProxy {
-	cipher, err := ss.NewCipher(method, passwd)
+	cipher, err := newSsCipher(method, passwd)
 	if err != nil {
 		Fatal("can't initialize cow proxy server", err)
 	}
@@ -247,9 +310,36 @@ func (cp *cowProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 			debug.Println("exiting cow listner")
 			break
 		}
-		ssConn := ss.NewConn(conn, cp.cipher.Copy())
-		c := newClientConn(ssConn, cp)
-		go c.serve()
+		go cp.serveConn(conn)
+	}
+}
+
+// serveConn serves either a plain cow connection, or a mux session if
+// client starts with muxMagic.
+func (cp *cowProxy) serveConn(conn net.Conn) {
+	c := cp.cipher.conn(conn)
+	c.SetReadDeadline(time.Now().Add(clientConnTimeout))
+	magic := make([]byte, len(muxMagic))
+	if _, err := io.ReadFull(c, magic[:1]); err != nil {
+		debug.Printf("cow client %s: %v\n", conn.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if magic[0] != muxMagic[0] {
+		c.SetReadDeadline(time.Time{})
+		newClientConn(&prefixConn{c, magic[:1]}, cp).serve()
+		return
+	}
+	if _, err := io.ReadFull(c, magic[1:]); err != nil || !bytes.Equal(magic, muxMagic) {
+		errl.Printf("cow client %s: bad mux magic %v\n", conn.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	debug.Println("mux session from cow client", conn.RemoteAddr())
+	sess := newMuxSession(c, true)
+	for st := range sess.accept {
+		go newClientConn(st, cp).serve()
 	}
 }
 
@@ -290,14 +380,14 @@ func (c *clientConn) setReadTimeout(msg string) {
 	// Always keep connections alive for cow conn from client for more reuse.
 	// For other client connections, set read timeout so we can close the
 	// connection after a period of idle to reduce number of open connections.
-	if _, ok := c.Conn.(*ss.Conn); !ok {
+	if _, ok := c.proxy.(*cowProxy); !ok {
 		// make actual timeout a little longer than keep-alive value sent to client
 		setConnReadTimeout(c.Conn, clientConnTimeout+2*time.Second, msg)
 	}
 }
 
 func (c *clientConn) unsetReadTimeout(msg string) {
-	if _, ok := c.Conn.(*ss.Conn); !ok {
+	if _, ok := c.proxy.(*cowProxy); !ok {
 		unsetConnReadTimeout(c.Conn, msg)
 	}
 }
@@ -362,11 +452,36 @@ func (c *clientConn) serveSelfURL(r *Request) (err error) {
 		goto end
 	}
 	if r.URL.Path == "/pac" || strings.HasPrefix(r.URL.Path, "/pac?") {
-		sendPAC(c)
-		// PAC header contains connection close, send non nil error to close
-		// client connection.
+		if err = sendPAC(c, r); err != nil || !r.ConnectionKeepAlive {
+			// Send non nil error to close client connection.
+			return errPageSent
+		}
+		return nil
+	}
+	if r.URL.Path == "/stat" && config.ShareStat {
+		// Stat reveals sites visited through this cow.
+		if !c.selfPageAllowed() {
+			sendSelfPageForbidden(c, r)
+		} else {
+			sendStat(c)
+		}
+		return errPageSent
+	}
+	if r.URL.Path == "/why" || strings.HasPrefix(r.URL.Path, "/why?") {
+		sendWhy(c, r)
 		return errPageSent
 	}
+	if r.URL.Path == "/latency" {
+		if lp, ok := parentProxy.(*latencyParentPool); ok {
+			// Ranking reveals parent proxy addresses.
+			if !c.selfPageAllowed() {
+				sendSelfPageForbidden(c, r)
+			} else {
+				sendTextPage(c, lp.ranking())
+			}
+			return errPageSent
+		}
+	}
 end:
 	sendErrorPage(c, "404 not found", "Page not found",
 		genErrMsg(r, nil, "Serving request to COW proxy."))
@@ -391,8 +506,8 @@ func (c *clientConn) shouldRetry(r *Request, sv *serverConn, re error) bool {
 			debug.Printf("cli(%s) partial request, can't retry %v\n", c.RemoteAddr(), r)
 		}
 		sendErrorPage(c, "502 partial request", err.Error(),
-			genErrMsg(r, sv, "Request is too large to hold in buffer, can't retry. "+
-				"Refresh to retry may work."))
+			genErrMsg(r, sv, "Request body is too large to hold in buffer or "+
+				"not completely read, can't retry. Refresh to retry may work."))
 		return false
 	} else if r.raw == nil {
 		msg := "Please report issue to the developer: Non partial request with buffer released"
@@ -405,6 +520,7 @@ func (c *clientConn) shouldRetry(r *Request, sv *serverConn, re error) bool {
 			// In that case, consider the url as temp blocked and try parent proxy.
 			siteStat.TempBlocked(r.URL)
 			r.tryCnt = 0
+			r.traceRoute("too many retries, temp blocked")
 			return true
 		}
 		debug.Printf("cli(%s) can't retry %v tryCnt=%d\n", c.RemoteAddr(), r, r.tryCnt)
@@ -412,6 +528,7 @@ func (c *clientConn) shouldRetry(r *Request, sv *serverConn, re error) bool {
 			genErrMsg(r, sv, "Has tried several times."))
 		return false
 	}
+	r.traceRoute("retry on error: %v", re)
 	return true
 }
 
@@ -484,6 +601,9 @@ func (c *clientConn) serve() {
 			continue
 		}
 
+		if auth.required && !authed && c.clientCertAuthed() {
+			authed = true
+		}
 		if auth.required && !authed {
 			if err = Authenticate(c, &r); err != nil {
 				errl.Printf("cli(%s) %v\n", c.RemoteAddr(), err)
@@ -501,16 +621,6 @@ func (c *clientConn) serve() {
 			return
 		}
 
-		if r.ExpectContinue {
-			sendErrorPage(c, statusExpectFailed, "Expect header not supported",
-				"Please contact COW's developer if you see this.")
-			// Client may have sent request body at this point. Simply close
-			// connection so we don't need to handle this case.
-			// NOTE: sendErrorPage tells client the connection will keep alive, but
-			// actually it will close here.
-			return
-		}
-
 	retry:
 		r.tryOnce()
 		if bool(debug) && r.isRetry() {
@@ -557,6 +667,12 @@ func (c *clientConn) serve() {
 			}
 			return
 		}
+		if rp.Status == statusCodeSwitchingProtocols {
+			// Connection is now used by the new protocol, both connections
+			// are closed when done.
+			sv.doUpgrade(&r, c)
+			return
+		}
 		// Put server connection to pool, so other clients can use it.
 		_, isCowConn := sv.Conn.(cowConn)
 		if rp.ConnectionKeepAlive || isCowConn {
@@ -583,6 +699,37 @@ func (c *clientConn) serve() {
 	}
 }
 
+// serveTunnel handles CONNECT request created for clients not speaking HTTP
+// proxy protocol.
+func (c *clientConn) serveTunnel(r *Request) {
+	var sv *serverConn
+	var err error
+
+	dbgPrintRq(c, r)
+	if !config.TunnelAllowedPort[r.URL.Port] {
+		sendErrorPage(c, statusForbidden, "Forbidden tunnel port",
+			genErrMsg(r, nil, "Please contact proxy admin."))
+		return
+	}
+
+retry:
+	r.tryOnce()
+	if bool(debug) && r.isRetry() {
+		debug.Printf("cli(%s) retry request tryCnt=%d %v\n", c.RemoteAddr(), r.tryCnt, r)
+	}
+	if sv, err = c.getServerConn(r); err != nil {
+		if debug {
+			debug.Printf("cli(%s) failed to get server conn %v\n", c.RemoteAddr(), r)
+		}
+		return
+	}
+	// server connection will be closed in doConnect
+	err = sv.doConnect(r, c)
+	if c.shouldRetry(r, sv, err) {
+		goto retry
+	}
+}
+
 func genErrMsg(r *Request, sv *serverConn, what string) string {
 	if sv == nil {
 		return fmt.Sprintf("<p>HTTP Request <strong>%v</strong></p> <p>%s</p>", r, what)
@@ -659,9 +806,11 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 		}
 	*/
 
+	start := time.Now()
 	if err = parseResponse(sv, r, rp); err != nil {
 		return c.handleServerReadError(r, sv, err, "parse response")
 	}
+	updateConnLatency(sv.Conn, start)
 	dbgPrintRep(c, r, rp)
 	// After have received the first reponses from the server, we consider
 	// ther server as real instead of fake one caused by wrong DNS reply. So
@@ -670,7 +819,11 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	r.state = rsRecvBody
 	r.releaseBuf()
 
-	if _, err = c.Write(rp.rawResponse()); err != nil {
+	raw := rp.rawResponse()
+	if c.routeHeaderAllowed() {
+		raw = addRouteHeader(raw, r)
+	}
+	if _, err = c.Write(raw); err != nil {
 		return err
 	}
 
@@ -715,18 +868,66 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	return
 }
 
+// Server not supporting 100-continue will wait for request body. Client
+// usually sends request body after waiting for 1 second, so use the same
+// timeout value.
+const expectContinueTimeout = time.Second
+
+// readContinue waits for server's response to request with "Expect:
+// 100-continue" and relays 100 response to client. Returns true if server
+// sends final response instead, which is not read. If server does not
+// respond in time, returns false so request body is sent.
+func (c *clientConn) readContinue(sv *serverConn, r *Request, rp *Response) (final bool, err error) {
+	if err = sv.SetReadDeadline(time.Now().Add(expectContinueTimeout)); err != nil {
+		// Connection does not support timeout. Don't wait.
+		debug.Printf("cli(%s) can't wait for 100 response %v %v\n", c.RemoteAddr(), err, r)
+		return false, nil
+	}
+	sv.initBuf()
+	s, err := sv.bufRd.PeekSlice('\n')
+	unsetConnReadTimeout(sv.Conn, "readContinue")
+	if err != nil {
+		if isErrTimeout(err) {
+			debug.Printf("cli(%s) no 100 response in %v %v\n",
+				c.RemoteAddr(), expectContinueTimeout, r)
+			return false, nil
+		}
+		return false, c.handleServerReadError(r, sv, err, "wait 100 continue")
+	}
+	if f := FieldsN(s, 3); len(f) < 2 || string(f[1]) != "100" {
+		return true, nil
+	}
+
+	defer rp.releaseBuf()
+	if err = parseResponse(sv, r, rp); err != nil {
+		return false, c.handleServerReadError(r, sv, err, "parse 100 response")
+	}
+	dbgPrintRep(c, r, rp)
+	_, err = c.Write(rp.rawResponse())
+	return false, err
+}
+
 func (c *clientConn) getServerConn(r *Request) (*serverConn, error) {
-	siteInfo := siteStat.GetVisitCnt(r.URL)
+	siteInfo, reason := siteStat.lookupVisitCnt(r.URL)
+	r.traceRoute("site: %s, %s", reason, siteInfo.describe())
+	r.route = lookupRoute(r.URL.Host)
+	if r.route != nil {
+		r.traceRoute("route rule: %s", r.route)
+	}
+	defer recordRoute(r)
 	// For CONNECT method, always create new connection.
 	if r.isConnect {
 		return c.createServerConn(r, siteInfo)
 	}
-	sv := connPool.Get(r.URL.HostPort, siteInfo.AsDirect())
+	// Connections shared by all sites are created by the default parent
+	// pool, routed request should not use them.
+	sv := connPool.Get(r.URL.HostPort, siteInfo.AsDirect() || r.route != nil)
 	if sv != nil {
 		// For websites like feedly, the site itself is not blocked, but the
 		// content it loads may result reset. So we should reset server
 		// connection state to just connected.
 		sv.state = svConnected
+		r.traceRoute("reuse %s", sv.Conn)
 		if debug {
 			debug.Printf("cli(%s) connPool get %s\n", c.RemoteAddr(), r.URL.HostPort)
 		}
@@ -742,7 +943,7 @@ func connectDirect2(url *URL, siteInfo *VisitCnt, recursive bool) (net.Conn, err
 	var c net.Conn
 	var err error
 	if siteInfo.AlwaysDirect() {
-		c, err = net.Dial("tcp", url.HostPort)
+		c, err = dialResolved(url, siteInfo, 0)
 	} else {
 		to := dialTimeout
 		if siteInfo.OnceBlocked() && to >= defaultDialTimeout {
@@ -753,7 +954,7 @@ func connectDirect2(url *URL, siteInfo *VisitCnt, recursive bool) (net.Conn, err
 			// problems when network condition is bad.
 			to = maxTimeout
 		}
-		c, err = net.DialTimeout("tcp", url.HostPort, to)
+		c, err = dialResolved(url, siteInfo, to)
 	}
 	if err != nil {
 		debug.Printf("error direct connect to: %s %v\n", url.HostPort, err)
@@ -797,8 +998,13 @@ func maybeBlocked(err error) bool {
 // Connect to requested server according to whether it's visit count.
 // If direct connection fails, try parent proxies.
 func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn, err error) {
+	r.raced = false
+	if r.route != nil {
+		return c.connectRoute(r, siteInfo)
+	}
 	var errMsg string
 	if config.AlwaysProxy {
+		r.traceRoute("always proxy")
 		if srvconn, err = parentProxy.connect(r.URL); err == nil {
 			return
 		}
@@ -806,10 +1012,12 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 		goto fail
 	}
 	if siteInfo.AsBlocked() && !parentProxy.empty() {
+		r.traceRoute("as blocked, try parent proxy")
 		// In case of connection error to socks server, fallback to direct connection
 		if srvconn, err = parentProxy.connect(r.URL); err == nil {
 			return
 		}
+		r.traceRoute("parent proxy failed: %v", err)
 		if siteInfo.AlwaysBlocked() {
 			errMsg = genErrMsg(r, nil, "Parent proxy connection failed, always blocked site.")
 			goto fail
@@ -822,7 +1030,12 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 			return
 		}
 		errMsg = genErrMsg(r, nil, "Parent proxy and direct connection failed, maybe blocked site.")
+	} else if config.RaceDelay > 0 && !siteInfo.AlwaysDirect() && !parentProxy.empty() &&
+		!r.isRetry() {
+		r.traceRoute("race direct and parent proxy")
+		return c.connectRace(r, siteInfo)
 	} else {
+		r.traceRoute("try direct")
 		// In case of error on direction connection, try parent server
 		if srvconn, err = connectDirect(r.URL, siteInfo); err == nil {
 			return
@@ -844,6 +1057,7 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 		// TCP handshake.
 		// To simplify things and avoid error in my observation, always try
 		// parent proxy in case of Dial error.
+		r.traceRoute("direct failed: %v, try parent proxy", err)
 		var socksErr error
 		if srvconn, socksErr = parentProxy.connect(r.URL); socksErr == nil {
 			c.handleBlockedRequest(r, err)
@@ -853,11 +1067,13 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 			}
 			return srvconn, nil
 		}
-		errMsg = genErrMsg(r, nil,
-			"Direct and parent proxy connection failed, maybe blocked site.")
+		errMsg = genErrMsg(r, nil, fmt.Sprintf(
+			"Direct and parent proxy connection failed, maybe blocked site. Parent proxy error: %v.",
+			socksErr))
 	}
 
 fail:
+	r.traceRoute("failed: %v", err)
 	sendErrorPage(c, "504 Connection failed", err.Error(), errMsg)
 	return nil, errPageSent
 }
@@ -867,7 +1083,11 @@ func (c *clientConn) createServerConn(r *Request, siteInfo *VisitCnt) (*serverCo
 	if err != nil {
 		return nil, err
 	}
+	r.traceRoute("connected: %s", srvconn)
 	sv := newServerConn(srvconn, r.URL.HostPort, siteInfo)
+	sv.routed = r.route != nil
+	// Visit is counted when racing.
+	sv.visited = r.raced
 	if debug {
 		debug.Printf("cli(%s) connected to %s %d concurrent connections\n",
 			c.RemoteAddr(), sv.hostPort, incSrvConnCnt(sv.hostPort))
@@ -930,7 +1150,9 @@ func (sv *serverConn) Close() error {
 }
 
 func (sv *serverConn) maybeFake() bool {
-	return sv.state == svConnected && sv.isDirect() && !sv.siteInfo.AlwaysDirect()
+	// Routed connection is not retried with parent proxy.
+	return sv.state == svConnected && sv.isDirect() && !sv.siteInfo.AlwaysDirect() &&
+		!sv.routed
 }
 
 func setConnReadTimeout(cn net.Conn, d time.Duration, msg string) {
@@ -1000,6 +1222,7 @@ func copyServer2Client(sv *serverConn, c *clientConn, r *Request) (err error) {
 	total := 0
 	const directThreshold = 8192
 	readTimeoutSet := false
+	start := time.Now()
 	for {
 		// debug.Println("srv->cli")
 		if sv.maybeFake() {
@@ -1021,6 +1244,12 @@ func copyServer2Client(sv *serverConn, c *clientConn, r *Request) (err error) {
 			// debug.Printf("copyServer2Client read data: %v\n", err)
 			return
 		}
+		if total == 0 && r.isConnect && !r.raced {
+			// Data relayed after upgrade may be pushed by server at any
+			// time, so only CONNECT is used for latency. Racing records
+			// latency itself.
+			updateConnLatency(sv.Conn, start)
+		}
 		total += n
 		if _, err = c.Write(buf[0:n]); err != nil {
 			// debug.Printf("copyServer2Client write data: %v\n", err)
@@ -1081,7 +1310,7 @@ func copyClient2Server(c *clientConn, sv *serverConn, r *Request, srvStopped not
 
 	var n int
 
-	if r.isRetry() {
+	if r.isConnect && r.isRetry() {
 		if debug {
 			debug.Printf("cli(%s)->srv(%s) retry request %d bytes of buffered body\n",
 				c.RemoteAddr(), r.URL.HostPort, len(r.rawBody()))
@@ -1163,6 +1392,10 @@ var connEstablished = []byte("HTTP/1.1 200 Tunnel established\r\n\r\n")
 func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 	r.state = rsCreated
 
+	if r.raced {
+		// Tunnel is established and client has got reply when racing.
+		return sv.copyTunnel(r, c)
+	}
 	_, isHttpConn := sv.Conn.(httpConn)
 	_, isCowConn := sv.Conn.(cowConn)
 	if isHttpConn || isCowConn {
@@ -1174,24 +1407,55 @@ func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 				c.RemoteAddr(), err)
 			return err
 		}
+		// Only HTTP client can understand parent's response to CONNECT.
+		if !c.isHTTPClient() {
+			if err = sv.readConnectResponse(r, c); err != nil {
+				return err
+			}
+		}
 	} else if !r.isRetry() {
 		// debug.Printf("send connection confirmation to %s->%s\n", c.RemoteAddr(), r.URL.HostPort)
-		if _, err = c.Write(connEstablished); err != nil {
+		if err = c.sendTunnelEstablished(); err != nil {
 			debug.Printf("cli(%s) error send 200 Connecion established: %v\n",
 				c.RemoteAddr(), err)
 			return err
 		}
 	}
 
-	var cli2srvErr error
+	return sv.copyTunnel(r, c)
+}
+
+// doUpgrade relays data between client and server after server switches to
+// the protocol specified in request's Upgrade header, e.g. websocket.
+func (sv *serverConn) doUpgrade(r *Request, c *clientConn) (err error) {
+	if debug {
+		debug.Printf("cli(%s) upgraded to %s %v\n", c.RemoteAddr(), r.Upgrade, r)
+	}
+	// Server may send data right after 101 response.
+	if n := sv.bufRd.Buffered(); n > 0 {
+		buffered, _ := sv.bufRd.Peek(n)
+		if _, err = c.Write(buffered); err != nil {
+			sv.Close()
+			return
+		}
+	}
+	sv.releaseBuf()
+	return sv.copyTunnel(r, c)
+}
+
+// copyTunnel copies data in both direction until one side closes connection.
+// Server connection is closed on return.
+func (sv *serverConn) copyTunnel(r *Request, c *clientConn) (err error) {
+	cli2srvErr := make(chan error, 1)
 	done := make(chan struct{})
 	srvStopped := newNotification()
 	go func() {
 		// debug.Printf("doConnect: cli(%s)->srv(%s)\n", c.RemoteAddr(), r.URL.HostPort)
-		cli2srvErr = copyClient2Server(c, sv, r, srvStopped, done)
+		err := copyClient2Server(c, sv, r, srvStopped, done)
 		// Close sv to force read from server in copyServer2Client return.
 		// Note: there's no other code closing the server connection for CONNECT.
 		sv.Close()
+		cli2srvErr <- err
 	}()
 
 	// debug.Printf("doConnect: srv(%s)->cli(%s)\n", r.URL.HostPort, c.RemoteAddr())
@@ -1204,8 +1468,65 @@ func (sv *serverConn) doConnect(r *Request, c *clientConn) (err error) {
 		// close client connection to force read from client in copyClient2Server return
 		c.Conn.Close()
 	}
-	if isErrRetry(cli2srvErr) {
-		return cli2srvErr
+	// Wait copyClient2Server to return, so no goroutine is left using the
+	// connections after tunnel is done.
+	if e := <-cli2srvErr; isErrRetry(e) {
+		return e
+	}
+	return
+}
+
+// isHTTPClient returns true if the client connects with HTTP proxy protocol.
+func (c *clientConn) isHTTPClient() bool {
+	switch c.proxy.(type) {
+	case *httpProxy, *cowProxy:
+		return true
+	}
+	return false
+}
+
+func (c *clientConn) sendTunnelEstablished() (err error) {
+	switch c.proxy.(type) {
+	case *socksProxy:
+		return c.writeSocksReply(socksRepSucceeded)
+	case *redirProxy:
+		// Transparent proxy client thinks it's connecting to the server.
+		return
+	}
+	_, err = c.Write(connEstablished)
+	return
+}
+
+// readConnectResponse reads parent proxy's response to CONNECT request and
+// replies to client. Used for clients not speaking HTTP.
+func (sv *serverConn) readConnectResponse(r *Request, c *clientConn) (err error) {
+	var rp Response
+	sv.initBuf()
+	defer func() {
+		rp.releaseBuf()
+		sv.releaseBuf()
+	}()
+
+	start := time.Now()
+	if err = parseResponse(sv, r, &rp); err != nil {
+		return c.handleServerReadError(r, sv, err, "parse CONNECT response")
+	}
+	updateConnLatency(sv.Conn, start)
+	dbgPrintRep(c, r, &rp)
+	if rp.Status != 200 {
+		sendErrorPage(c, "502 parent proxy error", "Parent proxy refused CONNECT",
+			genErrMsg(r, sv, fmt.Sprintf("Parent proxy response: %s.", &rp)))
+		return errPageSent
+	}
+	if err = c.sendTunnelEstablished(); err != nil {
+		return
+	}
+	// Server may send data before client, e.g. ssh.
+	if n := sv.bufRd.Buffered(); n > 0 {
+		buffered, _ := sv.bufRd.Peek(n)
+		if _, err = c.Write(buffered); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -1253,15 +1574,20 @@ func (sv *serverConn) sendRequestHeader(r *Request, c *clientConn) (err error) {
 }
 
 func (sv *serverConn) sendRequestBody(r *Request, c *clientConn) (err error) {
-	// Send request body. If this is retry, r.raw contains request body and is
-	// sent while sending raw request.
-	if !r.hasBody() || r.isRetry() {
+	// Send request body. If this is retry and request body has been read,
+	// r.raw contains request body and is sent while sending raw request.
+	if !r.hasBody() || r.bodyBuffered() {
 		return
 	}
 
 	err = sendBody(newServerWriter(r, sv), c.bufRd, int(r.ContLen), r.Chunking)
 	if err != nil {
 		errl.Printf("cli(%s) send request body error %v %s\n", c.RemoteAddr(), err, r)
+		// The rest of the body is still in client connection, retry with
+		// buffered body will send incomplete request.
+		if r.bodyBuffered() {
+			r.partial = true
+		}
 		if isErrOpWrite(err) {
 			err = c.handleServerWriteError(r, sv, err, "send request body")
 		}
@@ -1279,13 +1605,28 @@ func (sv *serverConn) doRequest(c *clientConn, r *Request, rp *Response) (err er
 	if err = sv.sendRequestHeader(r, c); err != nil {
 		return
 	}
-	if err = sv.sendRequestBody(r, c); err != nil {
+	var final bool
+	if r.ExpectContinue && r.hasBody() && !r.bodyBuffered() {
+		r.state = rsWaitContinue
+		if final, err = c.readContinue(sv, r, rp); err != nil {
+			return
+		}
+	}
+	if final {
+		// Server responds without request body. Client may or may not send
+		// the body, so close client connection after the response.
+		r.ConnectionKeepAlive = false
+	} else if err = sv.sendRequestBody(r, c); err != nil {
 		return
 	}
 	r.state = rsSent
 	if err = c.readResponse(sv, r, rp); err == nil {
 		sv.updateVisit()
 	}
+	if final {
+		// Server may still be waiting for request body, don't reuse it.
+		rp.ConnectionKeepAlive = false
+	}
 	return err
 }
 
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"github.com/cyfdecyf/bufio"
+	"io"
+	"net"
 	"strings"
 	"testing"
 )
@@ -105,3 +107,181 @@ func TestInitSelfListenAddr(t *testing.T) {
 		}
 	}
 }
+
+func TestDoRequestExpectContinue(t *testing.T) {
+	const reqHeader = "PUT http://example.com/upload HTTP/1.1\r\nHost: example.com\r\n" +
+		"Expect: 100-continue\r\nContent-Length: 5\r\n\r\n"
+	testData := []struct {
+		serverRep   string // sent by server after reading request header
+		readBody    bool   // whether server reads request body
+		finalRep    string // sent by server after reading request body
+		cliContinue bool   // whether client should get 100 response
+		keepAlive   bool
+	}{
+		{"HTTP/1.1 100 Continue\r\n\r\n", true,
+			"HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok", true, true},
+		{"HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n", false,
+			"", false, false},
+	}
+
+	for _, td := range testData {
+		cliEnd, cliConn := net.Pipe()
+		srvEnd, srvConn := net.Pipe()
+		c := newClientConn(cliConn, newHttpProxy("127.0.0.1:7777", ""))
+		sv := newServerConn(directConn{srvConn}, "example.com:80", newVisitCnt(0, 0))
+
+		go cliEnd.Write([]byte(reqHeader))
+		var r Request
+		if err := parseRequest(c, &r); err != nil {
+			t.Fatal("parse request:", err)
+		}
+		if !r.ExpectContinue {
+			t.Error("Expect header not parsed")
+		}
+
+		srvDone := make(chan string)
+		go func() {
+			rd := bufio.NewReader(srvEnd)
+			var header bytes.Buffer
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					break
+				}
+				header.WriteString(line)
+				if line == "\r\n" {
+					break
+				}
+			}
+			srvEnd.Write([]byte(td.serverRep))
+			if td.readBody {
+				body := make([]byte, 5)
+				io.ReadFull(rd, body)
+				header.Write(body)
+				srvEnd.Write([]byte(td.finalRep))
+			}
+			srvDone <- header.String()
+		}()
+
+		cliDone := make(chan string)
+		go func() {
+			rd := bufio.NewReader(cliEnd)
+			var rep bytes.Buffer
+			line, _ := rd.ReadString('\n')
+			if strings.HasPrefix(line, "HTTP/1.1 100") {
+				rep.WriteString(line)
+				line, _ = rd.ReadString('\n') // end of 100 response
+				rep.WriteString(line)
+				cliEnd.Write([]byte("hello"))
+			} else {
+				rep.WriteString(line)
+			}
+			io.Copy(&rep, rd)
+			cliDone <- rep.String()
+		}()
+
+		var rp Response
+		err := sv.doRequest(c, &r, &rp)
+		if err != nil {
+			t.Error("doRequest error:", err)
+		}
+		srvGot := <-srvDone
+		cliConn.Close()
+		cliGot := <-cliDone
+
+		if !strings.Contains(srvGot, "Expect: 100-continue\r\n") {
+			t.Errorf("Expect header not forwarded:\n%s", srvGot)
+		}
+		if td.readBody && !strings.HasSuffix(srvGot, "\r\n\r\nhello") {
+			t.Errorf("request body not sent:\n%s", srvGot)
+		}
+		if td.cliContinue != strings.HasPrefix(cliGot, "HTTP/1.1 100 Continue\r\n\r\n") {
+			t.Errorf("client 100 response wrong:\n%s", cliGot)
+		}
+		if r.ConnectionKeepAlive != td.keepAlive || rp.ConnectionKeepAlive != td.keepAlive {
+			t.Errorf("keep alive should be %v for %q\n", td.keepAlive, td.serverRep)
+		}
+		if !td.keepAlive && !strings.Contains(cliGot, "Connection: close\r\n") {
+			t.Errorf("client should be told to close connection:\n%s", cliGot)
+		}
+		srvEnd.Close()
+		srvConn.Close()
+		cliEnd.Close()
+	}
+}
+
+func TestDoRequestUpgrade(t *testing.T) {
+	cliEnd, cliConn := net.Pipe()
+	srvEnd, srvConn := net.Pipe()
+	c := newClientConn(cliConn, newHttpProxy("127.0.0.1:7777", ""))
+	sv := newServerConn(directConn{srvConn}, "example.com:80", newVisitCnt(0, 0))
+	defer func() {
+		cliEnd.Close()
+		srvEnd.Close()
+	}()
+
+	go cliEnd.Write([]byte("GET http://example.com/chat HTTP/1.1\r\nHost: example.com\r\n" +
+		"Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	var r Request
+	if err := parseRequest(c, &r); err != nil {
+		t.Fatal("parse request:", err)
+	}
+	if !r.isUpgrade() || r.Upgrade != "websocket" {
+		t.Fatal("upgrade request not recognized")
+	}
+
+	srvDone := make(chan string)
+	go func() {
+		rd := bufio.NewReader(srvEnd)
+		var header bytes.Buffer
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				break
+			}
+			header.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+		}
+		// send data along with response
+		srvEnd.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\nsrv"))
+		buf := make([]byte, 3)
+		io.ReadFull(rd, buf)
+		header.Write(buf)
+		srvEnd.Close()
+		srvDone <- header.String()
+	}()
+
+	cliDone := make(chan string)
+	go func() {
+		const rep = "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\nsrv"
+		buf := make([]byte, len(rep))
+		io.ReadFull(cliEnd, buf)
+		cliEnd.Write([]byte("cli"))
+		cliDone <- string(buf)
+	}()
+
+	var rp Response
+	if err := sv.doRequest(c, &r, &rp); err != nil {
+		t.Fatal("doRequest error:", err)
+	}
+	if rp.Status != statusCodeSwitchingProtocols {
+		t.Fatal("response status should be 101, got", rp.Status)
+	}
+	sv.doUpgrade(&r, c)
+
+	srvGot := <-srvDone
+	if !strings.Contains(srvGot, "Connection: keep-alive, upgrade\r\nUpgrade: websocket\r\n") {
+		t.Errorf("upgrade header not sent to server:\n%s", srvGot)
+	}
+	if !strings.HasSuffix(srvGot, "\r\n\r\ncli") {
+		t.Errorf("client data not relayed to server:\n%s", srvGot)
+	}
+	cliGot := <-cliDone
+	if !strings.HasSuffix(cliGot, "\r\n\r\nsrv") {
+		t.Errorf("client got wrong response:\n%s", cliGot)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Racing direct and parent proxy connection, similar to happy eyeballs
+// (RFC 6555). For sites not known as always direct or blocked, parent proxy
+// connection is started config.RaceDelay after direct connection, and
+// whichever is usable first is used.
+//
+// For CONNECT, TCP connection to blocked site may succeed and get reset
+// later, so cow replies to client first and sends client's first data (TLS
+// client hello for HTTPS) on both connections. The connection whose server
+// replies first wins.
+
+// Wait client's first data this long after replying to CONNECT. Server
+// speaks first for some protocols, e.g. ssh.
+const raceHelloTimeout = 500 * time.Millisecond
+
+var errHelloTimeout = errors.New("timeout waiting server reply to client hello")
+
+type raceResult struct {
+	conn   net.Conn
+	direct bool
+	err    error
+}
+
+// connectRace is called instead of trying direct connection first.
+// Connection created by racing has the CONNECT tunnel established.
+func (c *clientConn) connectRace(r *Request, siteInfo *VisitCnt) (net.Conn, error) {
+	var hello []byte
+	if r.isConnect {
+		var err error
+		if hello, err = c.readClientHello(r); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(chan raceResult, 2)
+	// Visit count is updated when race is done, direct connection may
+	// still be in progress.
+	vc := *siteInfo
+	go func() {
+		srvconn, err := raceDial(r, hello, func() (net.Conn, error) {
+			return connectDirect(r.URL, &vc)
+		})
+		result <- raceResult{srvconn, true, err}
+	}()
+	pending := 1
+	parentStarted := false
+	startParent := func() {
+		parentStarted = true
+		pending++
+		go func() {
+			srvconn, err := raceDial(r, hello, func() (net.Conn, error) {
+				return parentProxy.connect(r.URL)
+			})
+			result <- raceResult{srvconn, false, err}
+		}()
+	}
+
+	timer := time.NewTimer(config.RaceDelay)
+	defer timer.Stop()
+	var directErr, parentErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !parentStarted {
+				startParent()
+			}
+		case res := <-result:
+			pending--
+			if res.err == nil {
+				go closeRaceLoser(result, pending)
+				r.raced = true
+				if res.direct {
+					siteInfo.DirectVisit()
+				} else {
+					if directErr != nil {
+						siteStat.TempBlocked(r.URL)
+					}
+					siteInfo.BlockedVisit()
+				}
+				if debug {
+					debug.Printf("cli(%s) race won by %s for %v\n", c.RemoteAddr(), res.conn, r)
+				}
+				return res.conn, nil
+			}
+			if !res.direct {
+				parentErr = res.err
+			} else if directErr = res.err; !parentStarted {
+				startParent()
+			}
+		}
+	}
+
+	r.traceRoute("race failed, direct: %v, parent proxy: %v", directErr, parentErr)
+	if r.isConnect {
+		// Client has got reply to CONNECT, can only close connection.
+		debug.Printf("cli(%s) race failed for %v, direct: %v, parent proxy: %v\n",
+			c.RemoteAddr(), r, directErr, parentErr)
+		return nil, directErr
+	}
+	sendErrorPage(c, "504 Connection failed", directErr.Error(), genErrMsg(r, nil, fmt.Sprintf(
+		"Direct and parent proxy connection failed, maybe blocked site. Parent proxy error: %v.",
+		parentErr)))
+	return nil, errPageSent
+}
+
+func closeRaceLoser(result chan raceResult, pending int) {
+	for i := 0; i < pending; i++ {
+		if res := <-result; res.conn != nil {
+			res.conn.Close()
+		}
+	}
+}
+
+// readClientHello replies to CONNECT and reads the first data sent by client.
+// Returns nil if client sends nothing in raceHelloTimeout.
+func (c *clientConn) readClientHello(r *Request) ([]byte, error) {
+	if err := c.sendTunnelEstablished(); err != nil {
+		return nil, err
+	}
+	setConnReadTimeout(c.Conn, raceHelloTimeout, "race client hello")
+	_, err := c.bufRd.Peek(1)
+	unsetConnReadTimeout(c.Conn, "race client hello")
+	if err != nil {
+		if isErrTimeout(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	hello := make([]byte, c.bufRd.Buffered())
+	c.bufRd.Read(hello)
+	// Store for retry, the same as serverWriter.
+	if r.raw != nil {
+		r.raw.Write(hello)
+	}
+	return hello, nil
+}
+
+// raceDial creates connection using dial. For CONNECT, it also creates
+// tunnel through http and cow parent proxy, and waits for server's reply
+// to client hello.
+func raceDial(r *Request, hello []byte, dial func() (net.Conn, error)) (net.Conn, error) {
+	srvconn, err := dial()
+	if err != nil || !r.isConnect {
+		return srvconn, err
+	}
+	err = parentTunnel(srvconn, r.URL.HostPort)
+	if err == nil && hello != nil {
+		srvconn, err = exchangeHello(srvconn, hello)
+	}
+	if err != nil {
+		srvconn.Close()
+		return nil, err
+	}
+	return srvconn, nil
+}
+
+// exchangeHello sends hello to server and waits for the reply, which will
+// be returned by the first read of the returned connection.
+func exchangeHello(srvconn net.Conn, hello []byte) (conn net.Conn, err error) {
+	if err = srvconn.SetDeadline(time.Now().Add(readTimeout)); err != nil {
+		// Connection does not support deadline. Close the connection on
+		// timeout to avoid blocking forever.
+		timer := time.AfterFunc(readTimeout, func() { srvconn.Close() })
+		defer func() {
+			if !timer.Stop() && err == nil {
+				err = errHelloTimeout
+			}
+		}()
+	} else {
+		defer srvconn.SetDeadline(zeroTime)
+	}
+	start := time.Now()
+	if _, err = srvconn.Write(hello); err != nil {
+		return srvconn, err
+	}
+	reply := make([]byte, 4096)
+	n, err := srvconn.Read(reply)
+	if err != nil {
+		return srvconn, err
+	}
+	updateConnLatency(srvconn, start)
+	return replaceInnerConn(srvconn, func(c net.Conn) net.Conn {
+		return &prefixConn{c, reply[:n]}
+	}), nil
+}
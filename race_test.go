@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeParent serves connections created through it with serve.
+type pipeParent struct {
+	serve func(net.Conn)
+}
+
+func (pp *pipeParent) connect(url *URL) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go pp.serve(c2)
+	return c1, nil
+}
+
+func (pp *pipeParent) getServer() string {
+	return "127.0.0.1:1"
+}
+
+func (pp *pipeParent) genConfig() string {
+	return ""
+}
+
+func setRaceParent(parent ParentProxy) func() {
+	savedPool, savedDelay := parentProxy, config.RaceDelay
+	pool := &backupParentPool{}
+	pool.add(parent)
+	parentProxy = pool
+	return func() {
+		parentProxy, config.RaceDelay = savedPool, savedDelay
+	}
+}
+
+func parseTestRequest(t *testing.T, req string) (*clientConn, net.Conn, *Request) {
+	cliEnd, cliConn := net.Pipe()
+	c := newClientConn(cliConn, newHttpProxy("127.0.0.1:7777", ""))
+	go cliEnd.Write([]byte(req))
+	var r Request
+	if err := parseRequest(c, &r); err != nil {
+		t.Fatal("parse request:", err)
+	}
+	return c, cliEnd, &r
+}
+
+func TestConnectRaceDirectWin(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	parent := &fakeParent{server: "127.0.0.1:1"}
+	defer setRaceParent(parent)()
+	config.RaceDelay = time.Minute
+
+	c, cliEnd, r := parseTestRequest(t, "GET http://"+ln.Addr().String()+"/ HTTP/1.1\r\n\r\n")
+	defer cliEnd.Close()
+	siteInfo := newVisitCnt(0, 0)
+	srvconn, err := c.connectRace(r, siteInfo)
+	if err != nil {
+		t.Fatal("race should succeed:", err)
+	}
+	srvconn.Close()
+	if _, ok := srvconn.(directConn); !ok {
+		t.Error("direct connection should win")
+	}
+	if parent.cnt != 0 {
+		t.Error("parent proxy should not be tried before race delay")
+	}
+	if !r.raced || siteInfo.Direct != 1 {
+		t.Error("direct visit should be recorded")
+	}
+}
+
+func TestConnectRaceTunnel(t *testing.T) {
+	// Direct connection succeeds but server never replies, as blocked sites
+	// often behave.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Close accepted connections when test is done, so direct connection
+	// in race does not outlive the test.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-stop
+				c.Close()
+			}()
+		}
+	}()
+
+	defer setRaceParent(&pipeParent{func(c net.Conn) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err == nil && string(buf) == "hello" {
+			c.Write([]byte("world"))
+		}
+	}})()
+	config.RaceDelay = 50 * time.Millisecond
+
+	hostPort := ln.Addr().String()
+	c, cliEnd, r := parseTestRequest(t, "CONNECT "+hostPort+" HTTP/1.1\r\nHost: "+hostPort+"\r\n\r\n")
+	defer cliEnd.Close()
+	cliGot := make(chan string, 1)
+	go func() {
+		buf := make([]byte, len(connEstablished))
+		io.ReadFull(cliEnd, buf)
+		cliGot <- string(buf)
+		cliEnd.Write([]byte("hello"))
+	}()
+
+	siteInfo := newVisitCnt(0, 0)
+	srvconn, err := c.connectRace(r, siteInfo)
+	if err != nil {
+		t.Fatal("race should succeed:", err)
+	}
+	defer srvconn.Close()
+	if got := <-cliGot; got != string(connEstablished) {
+		t.Errorf("client should get CONNECT reply before racing, got %q\n", got)
+	}
+	if _, ok := srvconn.(directConn); ok {
+		t.Fatal("parent proxy should win if direct server does not reply")
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(srvconn, buf); err != nil || string(buf) != "world" {
+		t.Errorf("server reply should be returned by connection, got %q %v\n", buf, err)
+	}
+	if !r.raced || siteInfo.Blocked != 1 {
+		t.Error("blocked visit should be recorded")
+	}
+	if string(r.rawBody()) != "hello" {
+		t.Errorf("client hello should be saved for retry, got %q\n", r.rawBody())
+	}
+}
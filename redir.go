@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transparent proxy. Connections redirected by iptables REDIRECT target are
+// handled as CONNECT request to the original destination. Domain name is
+// sniffed from TLS ClientHello or HTTP Host header so site stat is still
+// based on domain. Example iptables rule:
+//
+//   iptables -t nat -A PREROUTING -i eth1 -p tcp -j REDIRECT --to-ports 7778
+
+// Clients of protocols like TLS and HTTP sends data immediately after
+// connected. Don't wait for too long for protocols that server sends data
+// first.
+const redirSniffTimeout = 300 * time.Millisecond
+
+type redirProxy struct {
+	addr string
+}
+
+func newRedirProxy(addr string) *redirProxy {
+	return &redirProxy{addr}
+}
+
+func (rp *redirProxy) genConfig() string {
+	return fmt.Sprintf("listen = redir://%s", rp.addr)
+}
+
+func (rp *redirProxy) Addr() string {
+	return rp.addr
+}
+
+func (rp *redirProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer func() {
+		wg.Done()
+	}()
+
+	ln, err := net.Listen("tcp", rp.addr)
+	if err != nil {
+		fmt.Println("listen redir failed:", err)
+		return
+	}
+	info.Printf("COW %s transparent proxy address %s\n", version, rp.addr)
+	var exit bool
+	go func() {
+		<-quit
+		exit = true
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil && !exit {
+			errl.Printf("redir proxy(%s) accept %v\n", ln.Addr(), err)
+			if isErrTooManyOpenFd(err) {
+				connPool.CloseAll()
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if exit {
+			debug.Println("exiting redir listner")
+			break
+		}
+		c := newClientConn(conn, rp)
+		go c.serveRedir()
+	}
+}
+
+func (c *clientConn) serveRedir() {
+	var r Request
+	defer func() {
+		r.releaseBuf()
+		c.Close()
+	}()
+
+	if !c.redirAllowed() {
+		errl.Printf("cli(%s) not allowed to use transparent proxy\n", c.RemoteAddr())
+		return
+	}
+	dst, err := getOriginalDst(c.Conn)
+	if err != nil {
+		errl.Printf("cli(%s) get original destination %v\n", c.RemoteAddr(), err)
+		return
+	}
+	if dst.String() == c.LocalAddr().String() {
+		// Not redirected, connecting to ourself will loop forever.
+		errl.Printf("cli(%s) connects to transparent proxy directly\n", c.RemoteAddr())
+		return
+	}
+
+	hostPort := dst.String()
+	if host := c.sniffHost(); host != "" {
+		hostPort = net.JoinHostPort(host, fmt.Sprint(dst.Port))
+	}
+	url := &URL{}
+	url.ParseHostPort(hostPort)
+	initConnectRequest(&r, url)
+	c.serveTunnel(&r)
+}
+
+// redirAllowed checks client IP as transparent proxy client can't do
+// username/password authentication.
+func (c *clientConn) redirAllowed() bool {
+	if !auth.required {
+		return true
+	}
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	return auth.authed.has(clientIP) || authIP(clientIP)
+}
+
+// sniffHost returns the server name in TLS ClientHello or Host header in
+// HTTP request. Returns empty string if none is found. Sniffed data is kept
+// in the read buffer and will be sent to server.
+func (c *clientConn) sniffHost() (host string) {
+	setConnReadTimeout(c.Conn, redirSniffTimeout, "redir sniff")
+	defer unsetConnReadTimeout(c.Conn, "redir sniff")
+
+	b, err := c.bufRd.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if b[0] == tlsRecordHandshake {
+		return c.sniffTLS()
+	}
+	return c.sniffHTTP()
+}
+
+func (c *clientConn) sniffTLS() string {
+	b, err := c.bufRd.Peek(5)
+	if err != nil {
+		return ""
+	}
+	n := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+	if n > len(c.buf) {
+		n = len(c.buf)
+	}
+	if b, err = c.bufRd.Peek(n); err != nil && err != io.EOF {
+		debug.Printf("cli(%s) sniff TLS %v\n", c.RemoteAddr(), err)
+	}
+	return parseTLSServerName(b)
+}
+
+func (c *clientConn) sniffHTTP() string {
+	// Read until the end of header or buffer is full.
+	var b []byte
+	var err error
+	for n := 1; n <= len(c.buf); n = len(b) + 1 {
+		if b, err = c.bufRd.Peek(n); err != nil {
+			break
+		}
+		if n = c.bufRd.Buffered(); n > len(b) {
+			b, _ = c.bufRd.Peek(n)
+		}
+		if bytes.Contains(b, []byte("\r\n\r\n")) || bytes.Contains(b, []byte("\n\n")) {
+			break
+		}
+	}
+	return parseHTTPHost(b)
+}
+
+const (
+	tlsRecordHandshake      = 0x16
+	tlsHandshakeClientHello = 1
+	tlsExtServerName        = 0
+	tlsServerNameHostName   = 0
+)
+
+// parseTLSServerName returns server name indication in a TLS ClientHello
+// record. Returns empty string if not found or data is incomplete.
+// Refer to rfc 5246 7.4.1.2 and rfc 6066 3 for the message format.
+func parseTLSServerName(b []byte) string {
+	// record header: type(1) version(2) length(2)
+	if len(b) < 5 || b[0] != tlsRecordHandshake {
+		return ""
+	}
+	b = b[5:]
+	// handshake header: type(1) length(3)
+	if len(b) < 4 || b[0] != tlsHandshakeClientHello {
+		return ""
+	}
+	b = b[4:]
+	// client version(2) random(32)
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+
+	// skip session id, cipher suites and compression methods
+	var ok bool
+	if b, ok = skipTLSVector(b, 1); !ok {
+		return ""
+	}
+	if b, ok = skipTLSVector(b, 2); !ok {
+		return ""
+	}
+	if b, ok = skipTLSVector(b, 1); !ok {
+		return ""
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	ext := b[2:]
+	if n := int(binary.BigEndian.Uint16(b)); n < len(ext) {
+		ext = ext[:n]
+	}
+	for len(ext) >= 4 {
+		typ := binary.BigEndian.Uint16(ext)
+		n := int(binary.BigEndian.Uint16(ext[2:]))
+		ext = ext[4:]
+		if n > len(ext) {
+			return ""
+		}
+		if typ != tlsExtServerName {
+			ext = ext[n:]
+			continue
+		}
+		// server name list length(2), then name type(1) name length(2)
+		data := ext[:n]
+		if len(data) < 2 {
+			return ""
+		}
+		data = data[2:]
+		for len(data) >= 3 {
+			nameType := data[0]
+			nameLen := int(binary.BigEndian.Uint16(data[1:]))
+			data = data[3:]
+			if nameLen > len(data) {
+				return ""
+			}
+			if nameType == tlsServerNameHostName {
+				return string(data[:nameLen])
+			}
+			data = data[nameLen:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// skipTLSVector skips variable length vector with length field of
+// lenSize bytes.
+func skipTLSVector(b []byte, lenSize int) ([]byte, bool) {
+	if len(b) < lenSize {
+		return nil, false
+	}
+	var n int
+	for i := 0; i < lenSize; i++ {
+		n = n<<8 | int(b[i])
+	}
+	b = b[lenSize:]
+	if n > len(b) {
+		return nil, false
+	}
+	return b[n:], true
+}
+
+// parseHTTPHost returns host without port in the Host header of a HTTP
+// request. Returns empty string if not found.
+func parseHTTPHost(b []byte) string {
+	// request line should contains method, URI and version
+	id := bytes.IndexByte(b, '\n')
+	if id == -1 || len(FieldsN(b[:id], 3)) != 3 {
+		return ""
+	}
+	b = b[id+1:]
+	for {
+		id = bytes.IndexByte(b, '\n')
+		if id == -1 {
+			return ""
+		}
+		line := TrimSpace(b[:id])
+		b = b[id+1:]
+		if len(line) == 0 {
+			return ""
+		}
+		name, val, err := splitHeader(line)
+		if err != nil || string(name) != headerHost {
+			continue
+		}
+		url := &URL{}
+		url.ParseHostPort(string(val))
+		return url.Host
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const redirSupported = true
+
+// From linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+)
+
+// getOriginalDst returns the destination address before redirected by
+// iptables.
+func getOriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not tcp connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isIPv4 := tc.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var addr *net.TCPAddr
+	var sysErr error
+	err = rc.Control(func(fd uintptr) {
+		// Use getsockopt wrappers with large enough result type to get
+		// sockaddr_in and sockaddr_in6.
+		if isIPv4 {
+			var mreq *syscall.IPv6Mreq
+			mreq, sysErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sysErr != nil {
+				return
+			}
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(b[2])<<8 | int(b[3]),
+			}
+		} else {
+			var info *syscall.IPv6MTUInfo
+			info, sysErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if sysErr != nil {
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sysErr != nil {
+		return nil, sysErr
+	}
+	return addr, nil
+}
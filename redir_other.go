@@ -0,0 +1,14 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const redirSupported = false
+
+func getOriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy only supported on Linux")
+}
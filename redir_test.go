@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseTLSServerName(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer srv.Close()
+	go func() {
+		tc := tls.Client(cli, &tls.Config{ServerName: "www.g.com"})
+		tc.Handshake() // fails after ClientHello is sent as srv is closed
+		cli.Close()
+	}()
+
+	buf := make([]byte, httpBufSize)
+	n := 0
+	for n < 5 || n < 5+(int(buf[3])<<8|int(buf[4])) {
+		m, err := srv.Read(buf[n:])
+		if err != nil {
+			t.Fatal("read ClientHello:", err)
+		}
+		n += m
+	}
+	hello := buf[:n]
+
+	if name := parseTLSServerName(hello); name != "www.g.com" {
+		t.Errorf("server name should be www.g.com, got %q\n", name)
+	}
+	// incomplete record should not cause problem
+	for _, l := range []int{0, 5, 43, n / 2, n - 1} {
+		if name := parseTLSServerName(hello[:l]); name != "" && name != "www.g.com" {
+			t.Errorf("incomplete ClientHello of %d bytes got server name %q\n", l, name)
+		}
+	}
+	if name := parseTLSServerName([]byte("GET / HTTP/1.1\r\n")); name != "" {
+		t.Errorf("non TLS data got server name %q\n", name)
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	testData := []struct {
+		raw  string
+		host string
+	}{
+		{"GET / HTTP/1.1\r\nHost: www.g.com\r\n\r\n", "www.g.com"},
+		{"POST /a HTTP/1.1\r\nAccept: */*\r\nhost: g.com:8080\r\n\r\n", "g.com"},
+		{"GET / HTTP/1.1\nHOST: g.com\n\n", "g.com"},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: g.com\r\n", ""},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n", ""},
+		{"SSH-2.0-OpenSSH_6.6\r\n", ""},
+		{"", ""},
+	}
+	for _, td := range testData {
+		if host := parseHTTPHost([]byte(td.raw)); host != td.host {
+			t.Errorf("%q host should be %q, got %q\n", td.raw, td.host, host)
+		}
+	}
+}
+
+func TestRedirAllowed(t *testing.T) {
+	savedRequired, savedClient, savedAuthed := auth.required, auth.allowedClient, auth.authed
+	defer func() {
+		auth.required, auth.allowedClient, auth.authed = savedRequired, savedClient, savedAuthed
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClientConn(conn, newRedirProxy("127.0.0.1:7778"))
+	defer c.Close()
+
+	auth.required = false
+	if !c.redirAllowed() {
+		t.Error("client should be allowed if no authentication required")
+	}
+	auth.required = true
+	auth.authed = NewTimeoutSet(time.Hour)
+	parseAllowedClient("192.168.1.0/24")
+	if c.redirAllowed() {
+		t.Error("client not in allowedClient should not be allowed")
+	}
+	parseAllowedClient("127.0.0.1")
+	if !c.redirAllowed() {
+		t.Error("client in allowedClient should be allowed")
+	}
+}
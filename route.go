@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+// Special route targets. Other targets are parent proxy group names.
+const (
+	routeDirect  = "direct"
+	routeReject  = "reject"
+	routeDefault = "default" // the default parent pool
+)
+
+// routeRule maps hosts matching pattern to target. Refer to hostPattern for
+// pattern syntax.
+type routeRule struct {
+	*hostPattern
+	target string
+}
+
+func (rule *routeRule) String() string {
+	return rule.pattern + " " + rule.target
+}
+
+func newRouteRule(pattern, target string) (*routeRule, error) {
+	hp, err := newHostPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &routeRule{hp, target}, nil
+}
+
+// Route rules are checked in order, the first matching rule is used.
+var routeRules []*routeRule
+
+// lookupRoute returns the first route rule matching host, nil if none.
+func lookupRoute(host string) *routeRule {
+	for _, rule := range routeRules {
+		if rule.match(host) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// parseRouteFile parses route rules, each line has the form "pattern target".
+func parseRouteFile(fpath string) (rules []*routeRule, err error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		arr := strings.Fields(line)
+		if len(arr) != 2 {
+			return nil, fmt.Errorf("%s:%d: route rule should be \"pattern target\"", fpath, n)
+		}
+		rule, err := newRouteRule(arr[0], arr[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fpath, n, err)
+		}
+		if err = checkRouteTarget(rule.target); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fpath, n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func checkRouteTarget(target string) error {
+	switch target {
+	case routeDirect, routeReject, routeDefault:
+		return nil
+	}
+	if _, ok := parentGroup[target]; !ok {
+		return errors.New("unknown parent proxy group " + target)
+	}
+	return nil
+}
+
+// initRoute must be called after initParentPool, as route targets are
+// checked against parent proxy groups.
+func initRoute() {
+	if err := isFileExists(config.RouteFile); err != nil {
+		if !os.IsNotExist(err) {
+			Fatal("route file:", err)
+		}
+		return
+	}
+	rules, err := parseRouteFile(config.RouteFile)
+	if err != nil {
+		Fatal("route file:", err)
+	}
+	routeRules = rules
+	debug.Printf("loaded %d route rules\n", len(routeRules))
+}
+
+// connectRoute connects according to the route rule matching the request.
+// No fallback is tried if connection fails.
+func (c *clientConn) connectRoute(r *Request, siteInfo *VisitCnt) (srvconn net.Conn, err error) {
+	rule := r.route
+	var errMsg string
+	switch rule.target {
+	case routeReject:
+		r.traceRoute("rejected")
+		sendErrorPage(c, "403 Forbidden", "Request rejected",
+			genErrMsg(r, nil, fmt.Sprintf("Rejected by route rule \"%s\".", rule)))
+		return nil, errPageSent
+	case routeDirect:
+		if srvconn, err = connectDirect(r.URL, siteInfo); err == nil {
+			return
+		}
+		errMsg = fmt.Sprintf("Direct connection failed, route rule \"%s\".", rule)
+	default:
+		pool := parentProxy
+		if rule.target != routeDefault {
+			pool = parentGroup[rule.target]
+		}
+		if srvconn, err = pool.connect(r.URL); err == nil {
+			return
+		}
+		errMsg = fmt.Sprintf("Parent proxy connection failed, route rule \"%s\".", rule)
+	}
+	r.traceRoute("failed: %v", err)
+	sendErrorPage(c, "504 Connection failed", err.Error(), genErrMsg(r, nil, errMsg))
+	return nil, errPageSent
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRouteRuleMatch(t *testing.T) {
+	testData := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"corp.example", "corp.example", true},
+		{"corp.example", "www.Corp.Example", true},
+		{"corp.example", "acorp.example", false},
+		{".corp.example", "a.b.corp.example", true},
+		{"*.corp.example", "corp.example", false},
+		{"*.corp.example", "a.b.corp.example", true},
+		{"video.*", "video.example.com", true},
+		{"video.*", "www.video.com", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+		{"10.0.0.0/8", "10.example.com", false},
+		{"192.168.1.1", "192.168.1.1", true},
+		{"192.168.1.1", "192.168.1.2", false},
+		{"fd00::/8", "fd00::1", true},
+	}
+	for _, td := range testData {
+		rule, err := newRouteRule(td.pattern, routeDirect)
+		if err != nil {
+			t.Errorf("%s unexpected error: %v\n", td.pattern, err)
+			continue
+		}
+		if rule.match(td.host) != td.match {
+			t.Errorf("%s match %s should be %v\n", td.pattern, td.host, td.match)
+		}
+	}
+	if _, err := newRouteRule("[a-", routeDirect); err == nil {
+		t.Error("invalid wildcard should return error")
+	}
+}
+
+func TestParseRouteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := parentGroup
+	defer func() { parentGroup = saved }()
+	parentGroup = map[string]ParentPool{"office": &backupParentPool{}}
+
+	fpath := path.Join(dir, "route")
+	content := "# comment\n" +
+		"*.corp.example office\n" +
+		"\n" +
+		"ads.example.com reject\n" +
+		"example.com direct\n" +
+		"10.0.0.0/8 default\n"
+	if err := ioutil.WriteFile(fpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := parseRouteFile(fpath)
+	if err != nil {
+		t.Fatal("parse route file:", err)
+	}
+	if len(rules) != 4 {
+		t.Fatal("should parse 4 rules, got", len(rules))
+	}
+
+	savedRules := routeRules
+	defer func() { routeRules = savedRules }()
+	routeRules = rules
+	testData := []struct {
+		host   string
+		target string
+	}{
+		{"www.corp.example", "office"},
+		{"ads.example.com", routeReject},
+		{"www.example.com", routeDirect},
+		{"10.0.0.1", routeDefault},
+		{"example.org", ""},
+	}
+	for _, td := range testData {
+		rule := lookupRoute(td.host)
+		if td.target == "" {
+			if rule != nil {
+				t.Errorf("%s should not match any rule, got %s\n", td.host, rule)
+			}
+			continue
+		}
+		if rule == nil || rule.target != td.target {
+			t.Errorf("%s should route to %s, got %v\n", td.host, td.target, rule)
+		}
+	}
+
+	for _, bad := range []string{"example.com\n", "example.com unknown\n"} {
+		if err := ioutil.WriteFile(fpath, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseRouteFile(fpath); err == nil {
+			t.Errorf("%q should return error\n", bad)
+		}
+	}
+}
+
+func TestInitParentPoolGroup(t *testing.T) {
+	savedPool, savedGroup := parentProxy, parentGroup
+	savedInterval := config.HealthCheckInterval
+	defer func() {
+		parentProxy, parentGroup = savedPool, savedGroup
+		config.HealthCheckInterval = savedInterval
+	}()
+	config.HealthCheckInterval = 0
+	parentProxy = &backupParentPool{}
+	parentGroup = make(map[string]ParentPool)
+
+	var parser configParser
+	parser.ParseProxy("socks5://127.0.0.1:1080")
+	parser.ParseProxy("http://127.0.0.1:8080 group=office")
+	parser.ParseProxy("socks5://127.0.0.1:1081 group=default,video")
+	initParentPool()
+
+	pool, ok := parentProxy.(*backupParentPool)
+	if !ok || len(pool.parent) != 2 {
+		t.Fatal("default pool should contain 2 parents")
+	}
+	if pool.parent[1].getServer() != "127.0.0.1:1081" {
+		t.Error("parent with default group should be in default pool")
+	}
+	office, ok := parentGroup["office"].(*backupParentPool)
+	if !ok || len(office.parent) != 1 || office.parent[0].getServer() != "127.0.0.1:8080" {
+		t.Error("office group should contain only the http parent")
+	}
+	video, ok := parentGroup["video"].(*backupParentPool)
+	if !ok || len(video.parent) != 1 || video.parent[0].health != pool.parent[1].health {
+		t.Error("parent in multiple groups should share health")
+	}
+}
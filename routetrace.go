@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routing decision for each request is recorded, so users can find out why
+// a request is sent directly or through parent proxy without reading debug
+// log. Clients in config.RouteHeaderClient get the decision in X-Cow-Route
+// response header, and the latest decision for recently visited hosts is
+// shown at self URL /why?host=<host>.
+
+const (
+	headerCowRoute = "X-Cow-Route"
+	// Number of hosts to keep the latest routing decision.
+	routeTraceSize = 256
+)
+
+type routeTrace struct {
+	req   string
+	steps []string
+	time  time.Time
+}
+
+var routeTraces = struct {
+	sync.Mutex
+	m map[string]*routeTrace
+}{m: make(map[string]*routeTrace)}
+
+func (vc *VisitCnt) describe() string {
+	var s string
+	switch {
+	case vc.AlwaysDirect():
+		s = "always direct"
+	case vc.AlwaysBlocked():
+		s = "always blocked"
+	default:
+		s = fmt.Sprintf("direct %d blocked %d", vc.Direct, vc.Blocked)
+	}
+	if vc.AsTempBlocked() {
+		s += ", temp blocked"
+	}
+	return s
+}
+
+// traceRoute adds a step of routing decision for the request.
+func (r *Request) traceRoute(format string, args ...interface{}) {
+	r.trace = append(r.trace, fmt.Sprintf(format, args...))
+}
+
+// recordRoute saves routing decision of the request as the latest one for
+// the requested host.
+func recordRoute(r *Request) {
+	rt := &routeTrace{r.String(), append([]string(nil), r.trace...), time.Now()}
+	routeTraces.Lock()
+	defer routeTraces.Unlock()
+	if _, ok := routeTraces.m[r.URL.Host]; !ok && len(routeTraces.m) >= routeTraceSize {
+		var oldest string
+		for host, t := range routeTraces.m {
+			if oldest == "" || t.time.Before(routeTraces.m[oldest].time) {
+				oldest = host
+			}
+		}
+		delete(routeTraces.m, oldest)
+	}
+	routeTraces.m[r.URL.Host] = rt
+}
+
+func getRouteTrace(host string) *routeTrace {
+	routeTraces.Lock()
+	defer routeTraces.Unlock()
+	return routeTraces.m[host]
+}
+
+// routeHeaderAllowed checks whether the client should get X-Cow-Route header.
+func (c *clientConn) routeHeaderAllowed() bool {
+	if len(config.RouteHeaderClient) == 0 {
+		return false
+	}
+	ip := c.remoteIP()
+	return ip != nil && matchNetAddr(config.RouteHeaderClient, ip)
+}
+
+// selfPageAllowed checks whether the client can visit self pages revealing
+// proxy usage: /why and /stat show visited sites, /latency shows parent
+// proxies. Allowed for local clients and clients in config.RouteHeaderClient.
+func (c *clientConn) selfPageAllowed() bool {
+	ip := c.remoteIP()
+	return ip != nil && (ip.IsLoopback() || matchNetAddr(config.RouteHeaderClient, ip))
+}
+
+func sendSelfPageForbidden(c *clientConn, r *Request) {
+	sendErrorPage(c, statusForbidden, "Forbidden", genErrMsg(r, nil,
+		"Only local clients and clients in routeHeaderClient can visit this page."))
+}
+
+func (c *clientConn) remoteIP() net.IP {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// addRouteHeader returns raw response header with X-Cow-Route header added.
+func addRouteHeader(raw []byte, r *Request) []byte {
+	end := bytes.LastIndex(raw, []byte(CRLF+CRLF))
+	if end == -1 {
+		return raw
+	}
+	// Header value should not contain line break.
+	route := strings.NewReplacer("\r", " ", "\n", " ").Replace(strings.Join(r.trace, "; "))
+	b := make([]byte, 0, len(raw)+len(headerCowRoute)+len(route)+4)
+	b = append(b, raw[:end+len(CRLF)]...)
+	b = append(b, headerCowRoute+": "+route+CRLF...)
+	return append(b, raw[end+len(CRLF):]...)
+}
+
+// explainRoute describes how requests to host are routed.
+func explainRoute(host string) string {
+	var buf bytes.Buffer
+	u := &URL{}
+	u.ParseHostPort(host)
+	vc, reason := siteStat.lookupVisitCnt(u)
+	fmt.Fprintf(&buf, "host: %s\nsite: %s, %s\n", u.Host, reason, vc.describe())
+	if rule := lookupRoute(u.Host); rule != nil {
+		fmt.Fprintf(&buf, "route rule: %s\n", rule)
+	}
+	if config.AlwaysProxy {
+		buf.WriteString("always proxy\n")
+	}
+
+	rt := getRouteTrace(u.Host)
+	if rt == nil {
+		buf.WriteString("\nno recent request\n")
+		return buf.String()
+	}
+	fmt.Fprintf(&buf, "\nlatest request at %s: %s\n", rt.time.Format("2006-01-02 15:04:05"), rt.req)
+	for _, step := range rt.steps {
+		buf.WriteString("  " + step + "\n")
+	}
+	return buf.String()
+}
+
+// recentRouteHosts returns recently visited hosts in alphabetical order.
+func recentRouteHosts() []string {
+	routeTraces.Lock()
+	hosts := make([]string, 0, len(routeTraces.m))
+	for host := range routeTraces.m {
+		hosts = append(hosts, host)
+	}
+	routeTraces.Unlock()
+	sort.Strings(hosts)
+	return hosts
+}
+
+// sendWhy serves /why?host=<host>. Lists recently visited hosts if host is
+// not given.
+func sendWhy(c *clientConn, r *Request) {
+	if !c.selfPageAllowed() {
+		sendSelfPageForbidden(c, r)
+		return
+	}
+	var host string
+	if i := strings.Index(r.URL.Path, "?"); i != -1 {
+		if q, err := url.ParseQuery(r.URL.Path[i+1:]); err == nil {
+			host = strings.TrimSpace(q.Get("host"))
+		}
+	}
+	if host == "" {
+		sendTextPage(c, "Usage: /why?host=<host>\n\nRecently visited hosts:\n"+
+			strings.Join(recentRouteHosts(), "\n")+"\n")
+		return
+	}
+	sendTextPage(c, explainRoute(host))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddRouteHeader(t *testing.T) {
+	r := &Request{trace: []string{"site: new host", "try direct\r\n"}}
+	raw := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	got := string(addRouteHeader([]byte(raw), r))
+	want := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n" +
+		"X-Cow-Route: site: new host; try direct  \r\n\r\n"
+	if got != want {
+		t.Errorf("got %q\nwant %q\n", got, want)
+	}
+}
+
+func TestRouteTrace(t *testing.T) {
+	initConfig("")
+	defer setTestResolver()()
+	resolver.put("trace.example.com", []net.IP{net.ParseIP("127.0.0.1")}, time.Minute, false)
+	saved := siteStat
+	defer func() { siteStat = saved }()
+	siteStat = newSiteStat()
+
+	// Direct connection is refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	defer setRaceParent(&pipeParent{func(c net.Conn) { c.Close() }})()
+	config.RaceDelay = 0
+
+	c, cliEnd, r := parseTestRequest(t, "GET http://trace.example.com:"+port+"/ HTTP/1.1\r\n\r\n")
+	defer cliEnd.Close()
+	sv, err := c.getServerConn(r)
+	if err != nil {
+		t.Fatal("should connect through parent:", err)
+	}
+	sv.Close()
+
+	trace := strings.Join(r.trace, "; ")
+	for _, step := range []string{"site: new host, direct 0 blocked 0", "try direct",
+		"direct failed", "connected: "} {
+		if !strings.Contains(trace, step) {
+			t.Errorf("trace %q should contain %q\n", trace, step)
+		}
+	}
+	why := explainRoute("trace.example.com")
+	if !strings.Contains(why, "latest request") || !strings.Contains(why, "  try direct\n") {
+		t.Errorf("explanation should contain latest request:\n%s", why)
+	}
+	if why = explainRoute("other.example.com"); !strings.Contains(why, "no recent request") {
+		t.Errorf("host not visited should have no recent request:\n%s", why)
+	}
+}
+
+func TestRouteTraceClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClientConn(conn, newHttpProxy("127.0.0.1:7777", ""))
+	defer c.Close()
+
+	saved := config.RouteHeaderClient
+	defer func() { config.RouteHeaderClient = saved }()
+	config.RouteHeaderClient = nil
+	if c.routeHeaderAllowed() {
+		t.Error("route header should not be sent by default")
+	}
+	if !c.selfPageAllowed() {
+		t.Error("local client should be allowed to visit self pages")
+	}
+	config.RouteHeaderClient = parseNetAddrList("routeHeaderClient", "127.0.0.0/8, 192.168.1.1")
+	if !c.routeHeaderAllowed() {
+		t.Error("client in routeHeaderClient should get route header")
+	}
+}
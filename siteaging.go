@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Aging of learned site stat. Visit counts decay with configurable half
+// life, so a site blocked long ago is tried directly again, and vice versa.
+// Learned blocked sites can also be probed directly in the background.
+
+// Aging policy, set from config by initSiteAging.
+var (
+	tempBlockedTTL = defaultTempBlockedTTL
+	directSiteTTL  = siteStaleThreshold
+	blockedSiteTTL = siteStaleThreshold
+)
+
+func initSiteAging() {
+	tempBlockedTTL = config.TempBlockedTTL
+	directSiteTTL = config.DirectSiteTTL
+	blockedSiteTTL = config.BlockedSiteTTL
+}
+
+// decayCnt multiplies cnt by factor. Rounding is random so the expected
+// value is correct even if decay is applied in many small steps.
+func decayCnt(cnt vcntint, factor float64) vcntint {
+	if cnt <= 0 {
+		return cnt
+	}
+	f := float64(cnt) * factor
+	n := math.Floor(f)
+	if rand.Float64() < f-n {
+		n++
+	}
+	return vcntint(n)
+}
+
+// decay applies decay for the time elapsed since last decay to visit count
+// of learned sites.
+func (ss *SiteStat) decay(now time.Time) {
+	ss.vcLock.Lock()
+	defer ss.vcLock.Unlock()
+	last := ss.LastDecay
+	ss.LastDecay = now
+	if config.StatHalfLife <= 0 || last.IsZero() || !now.After(last) {
+		return
+	}
+	factor := math.Pow(0.5, float64(now.Sub(last))/float64(config.StatHalfLife))
+	for _, vc := range ss.Vcnt {
+		if vc.userSpecified() {
+			continue
+		}
+		vc.Direct = decayCnt(vc.Direct, factor)
+		vc.Blocked = decayCnt(vc.Blocked, factor)
+	}
+}
+
+// probeDirect checks whether host can be visited directly by TLS handshake
+// on port 443. GFW may allow TCP connection and reset it later, or poison
+// DNS, which are all detected by handshake with certificate verification.
+func probeDirect(host string, vc *VisitCnt) error {
+	url := &URL{}
+	url.ParseHostPort(host + ":443")
+	c, err := dialResolved(url, vc, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(readTimeout))
+	return tls.Client(c, &tls.Config{ServerName: host}).Handshake()
+}
+
+// reprobeBlocked probes learned blocked sites directly with probe, and
+// records a direct visit for sites which are reachable.
+func (ss *SiteStat) reprobeBlocked(probe func(host string, vc *VisitCnt) error) {
+	var sites []string
+	ss.vcLock.RLock()
+	for site, vc := range ss.Vcnt {
+		if !vc.userSpecified() && !vc.AsTempBlocked() && vc.mostlyBlocked() {
+			sites = append(sites, site)
+		}
+	}
+	ss.vcLock.RUnlock()
+
+	for _, site := range sites {
+		if networkBad() {
+			return
+		}
+		vc := ss.get(site)
+		if vc == nil {
+			continue
+		}
+		if err := probe(site, vc); err != nil {
+			debug.Printf("reprobe %s: %v\n", site, err)
+			continue
+		}
+		info.Printf("blocked site %s is reachable directly\n", site)
+		vc.DirectVisit()
+	}
+}
+
+func runReprobeBlocked() {
+	for {
+		time.Sleep(config.ReprobeInterval)
+		siteStat.reprobeBlocked(probeDirect)
+	}
+}
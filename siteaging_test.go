@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDecayCnt(t *testing.T) {
+	if n := decayCnt(100, 0.5); n != 50 {
+		t.Error("100 decay by half should be 50, got", n)
+	}
+	if n := decayCnt(userCnt, 0.5); n != userCnt {
+		t.Error("user specified count should not decay")
+	}
+	// Random rounding should keep expected value.
+	sum := 0
+	for i := 0; i < 10000; i++ {
+		sum += int(decayCnt(3, 0.5))
+	}
+	if avg := float64(sum) / 10000; avg < 1.4 || avg > 1.6 {
+		t.Error("average of decayed 3 by half should be about 1.5, got", avg)
+	}
+}
+
+func TestSiteStatDecay(t *testing.T) {
+	saved := config.StatHalfLife
+	defer func() { config.StatHalfLife = saved }()
+	config.StatHalfLife = 24 * time.Hour
+
+	ss := newSiteStat()
+	ss.loadList([]string{"user.com"}, userCnt, 0)
+	ss.Vcnt["learned.com"] = newVisitCnt(100, 40)
+	now := time.Now()
+	ss.decay(now) // first decay only records time
+	if vc := ss.get("learned.com"); vc.Direct != 100 {
+		t.Error("first decay should not change count")
+	}
+	ss.decay(now.Add(48 * time.Hour))
+	if vc := ss.get("learned.com"); vc.Direct != 25 || vc.Blocked != 10 {
+		t.Errorf("count after 2 half lives should be quarter, got %d %d\n", vc.Direct, vc.Blocked)
+	}
+	if !ss.get("user.com").AlwaysDirect() {
+		t.Error("user specified site should not decay")
+	}
+
+	config.StatHalfLife = 0
+	ss.decay(now.Add(96 * time.Hour))
+	if vc := ss.get("learned.com"); vc.Direct != 25 {
+		t.Error("should not decay if half life is 0")
+	}
+}
+
+func TestSiteStatDecayOnLoad(t *testing.T) {
+	saved := config.StatHalfLife
+	defer func() { config.StatHalfLife = saved }()
+	config.StatHalfLife = 24 * time.Hour
+
+	tmpDir, err := ioutil.TempDir("", "cow-decay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fpath := path.Join(tmpDir, "stat")
+
+	ss := newSiteStat()
+	ss.Vcnt["learned.com"] = newVisitCnt(100, 0)
+	ss.decay(time.Now().Add(-48 * time.Hour))
+	if err := ss.store(fpath); err != nil {
+		t.Fatal("store error:", err)
+	}
+	for i := 0; i < 2; i++ {
+		ld := newSiteStat()
+		if err := ld.load(fpath); err != nil {
+			t.Fatal("load error:", err)
+		}
+		// Only time since last decay should be decayed on each load.
+		if vc := ld.get("learned.com"); vc == nil || vc.Direct != 25 {
+			t.Fatalf("count after load %d should be quarter, got %v\n", i+1, vc)
+		}
+		if err := ld.store(fpath); err != nil {
+			t.Fatal("store error:", err)
+		}
+	}
+}
+
+func TestSiteStaleTTL(t *testing.T) {
+	savedDirect, savedBlocked := directSiteTTL, blockedSiteTTL
+	defer func() { directSiteTTL, blockedSiteTTL = savedDirect, savedBlocked }()
+	directSiteTTL, blockedSiteTTL = time.Hour, 48*time.Hour
+	recent := time.Now().Add(-2 * time.Hour)
+	if !newVisitCntWithTime(3, 0, recent).isStale() {
+		t.Error("direct site should use direct site TTL")
+	}
+	if newVisitCntWithTime(3, 1, recent).isStale() {
+		t.Error("blocked site should use blocked site TTL")
+	}
+}
+
+func TestReprobeBlocked(t *testing.T) {
+	initConfig("")
+	ss := newSiteStat()
+	ss.loadList([]string{"user.com"}, 0, userCnt)
+	ss.Vcnt["ok.com"] = newVisitCnt(0, 10)
+	ss.Vcnt["fail.com"] = newVisitCnt(0, 10)
+	ss.Vcnt["direct.com"] = newVisitCnt(10, 0)
+	temp := newVisitCnt(0, 10)
+	temp.tempBlocked()
+	ss.Vcnt["temp.com"] = temp
+
+	probed := make(map[string]bool)
+	ss.reprobeBlocked(func(host string, vc *VisitCnt) error {
+		probed[host] = true
+		if host == "fail.com" {
+			return errors.New("reset")
+		}
+		return nil
+	})
+	if len(probed) != 2 || !probed["ok.com"] || !probed["fail.com"] {
+		t.Error("only learned blocked sites should be probed, got", probed)
+	}
+	if !ss.get("ok.com").AsDirect() {
+		t.Error("reachable site should become direct")
+	}
+	if ss.get("fail.com").AsDirect() {
+		t.Error("unreachable site should still be blocked")
+	}
+}
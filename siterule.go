@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// hostPattern matches host against pattern, which can be:
+//
+//   - domain suffix: example.com or .example.com matches example.com and
+//     *.example.com
+//   - wildcard: *.example.* as in path.Match
+//   - regular expression: /^ad[0-9]+\./
+//   - IP or CIDR: 10.0.0.0/8 matches hosts given as IP address
+//
+// Host is converted to lower case before matching.
+type hostPattern struct {
+	pattern string
+
+	domain string // for domain suffix and wildcard
+	glob   bool
+	re     *regexp.Regexp
+	ipNet  *net.IPNet
+}
+
+func newHostPattern(pattern string) (*hostPattern, error) {
+	hp := &hostPattern{pattern: pattern}
+	if n := len(pattern); n > 2 && pattern[0] == '/' && pattern[n-1] == '/' {
+		re, err := regexp.Compile(pattern[1 : n-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %s: %v", pattern, err)
+		}
+		hp.re = re
+	} else if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		hp.ipNet = ipNet
+	} else if ip := net.ParseIP(pattern); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		hp.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid wildcard %s: %v", pattern, err)
+		}
+		hp.domain = strings.ToLower(pattern)
+		hp.glob = true
+	} else if strings.ContainsAny(pattern, "/!") {
+		return nil, fmt.Errorf("invalid host pattern %s", pattern)
+	} else {
+		hp.domain = strings.ToLower(strings.TrimPrefix(pattern, "."))
+	}
+	return hp, nil
+}
+
+// match reports whether host (without port) matches the pattern.
+func (hp *hostPattern) match(host string) bool {
+	if hp.ipNet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && hp.ipNet.Contains(ip)
+	}
+	host = strings.ToLower(host)
+	if hp.re != nil {
+		return hp.re.MatchString(host)
+	}
+	if hp.glob {
+		ok, _ := path.Match(hp.domain, host)
+		return ok
+	}
+	return host == hp.domain || strings.HasSuffix(host, "."+hp.domain)
+}
+
+// Syntax only supported by Go regexp. JavaScript regexp has the same
+// meaning for other commonly used syntax.
+var goOnlyRegexpSyntax = []string{"(?", `\p`, `\P`, `\z`, `\A`, `\Q`, "[[:"}
+
+// pacRule returns the pattern in the form understood by ruleMatch in PAC,
+// false if the pattern can't be expressed in PAC.
+func (hp *hostPattern) pacRule() (string, bool) {
+	var rule []string
+	switch {
+	case hp.re != nil:
+		expr := hp.re.String()
+		for _, s := range goOnlyRegexpSyntax {
+			if strings.Contains(expr, s) {
+				return "", false
+			}
+		}
+		rule = []string{"r", expr}
+	case hp.ipNet != nil:
+		ip := hp.ipNet.IP.To4()
+		if ip == nil || len(hp.ipNet.Mask) != net.IPv4len {
+			return "", false
+		}
+		rule = []string{"n", ip.String(), net.IP(hp.ipNet.Mask).String()}
+	case hp.glob:
+		// shExpMatch does not support character class.
+		if strings.Contains(hp.domain, "[") {
+			return "", false
+		}
+		rule = []string{"w", hp.domain}
+	default:
+		rule = []string{"s", hp.domain}
+	}
+	b, _ := json.Marshal(rule)
+	return string(b), true
+}
+
+// siteRuleList holds pattern rules in user specified blocked or direct
+// list. Rule with "!" prefix is an exception: host matching it is not
+// matched by the list, even if its domain is in the list.
+type siteRuleList struct {
+	rules  []*hostPattern
+	except []*hostPattern
+}
+
+// isPlainSite returns whether line in site list is a host or domain, which
+// is loaded into site stat.
+func isPlainSite(s string) bool {
+	return s[0] != '.' && !strings.ContainsAny(s, "!/*?[")
+}
+
+// addRules parses pattern rules in lst and returns the plain sites.
+func (l *siteRuleList) addRules(lst []string) (plain []string) {
+	for _, s := range lst {
+		if isPlainSite(s) {
+			plain = append(plain, s)
+			continue
+		}
+		negate := s[0] == '!'
+		hp, err := newHostPattern(strings.TrimPrefix(s, "!"))
+		if err != nil {
+			errl.Println("site list:", err)
+			continue
+		}
+		if negate {
+			l.except = append(l.except, hp)
+		} else {
+			l.rules = append(l.rules, hp)
+		}
+	}
+	return
+}
+
+func matchAnyPattern(pat []*hostPattern, host string) bool {
+	for _, hp := range pat {
+		if hp.match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns whether host matches any rule in the list, and whether it's
+// excluded from the list by an exception.
+func (l *siteRuleList) match(host string) (matched, excepted bool) {
+	if matchAnyPattern(l.except, host) {
+		return false, true
+	}
+	return matchAnyPattern(l.rules, host), false
+}
+
+func (l *siteRuleList) empty() bool {
+	return len(l.rules) == 0 && len(l.except) == 0
+}
+
+// pacRules returns rules and exceptions that can be expressed in PAC as
+// JavaScript array elements.
+func (l *siteRuleList) pacRules() (rules, except string) {
+	join := func(pat []*hostPattern) string {
+		var lst []string
+		for _, hp := range pat {
+			if r, ok := hp.pacRule(); ok {
+				lst = append(lst, r)
+			} else {
+				debug.Println("rule not supported in PAC:", hp.pattern)
+			}
+		}
+		return strings.Join(lst, ",\n")
+	}
+	return join(l.rules), join(l.except)
+}
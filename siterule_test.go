@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHostPatternRegexp(t *testing.T) {
+	testData := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{`/^ad[0-9]+\./`, "ad1.example.com", true},
+		{`/^ad[0-9]+\./`, "Ad12.example.com", true},
+		{`/^ad[0-9]+\./`, "bad1.example.com", false},
+		{`/cdn/`, "static.cdn.example.com", true},
+	}
+	for _, td := range testData {
+		hp, err := newHostPattern(td.pattern)
+		if err != nil {
+			t.Errorf("%s unexpected error: %v\n", td.pattern, err)
+			continue
+		}
+		if hp.match(td.host) != td.match {
+			t.Errorf("%s match %s should be %v\n", td.pattern, td.host, td.match)
+		}
+	}
+	for _, bad := range []string{"/[a-/", "a/b", "!a"} {
+		if _, err := newHostPattern(bad); err == nil {
+			t.Errorf("%s should return error\n", bad)
+		}
+	}
+}
+
+func TestSiteRuleList(t *testing.T) {
+	var l siteRuleList
+	plain := l.addRules([]string{
+		"example.com",
+		"1.2.3.4",
+		".example.org",
+		"!ads.example.org",
+		"*.cdn.*",
+		"/^ad[0-9]+\\./",
+		"10.0.0.0/8",
+		"/[a-/",
+	})
+	if len(plain) != 2 || plain[0] != "example.com" || plain[1] != "1.2.3.4" {
+		t.Error("plain sites should be returned, got", plain)
+	}
+	if len(l.rules) != 4 || len(l.except) != 1 {
+		t.Fatalf("should have 4 rules and 1 exception, got %d %d\n", len(l.rules), len(l.except))
+	}
+
+	testData := []struct {
+		host     string
+		matched  bool
+		excepted bool
+	}{
+		{"example.org", true, false},
+		{"www.example.org", true, false},
+		{"ads.example.org", false, true},
+		{"x.ads.example.org", false, true},
+		{"img.cdn.example.net", true, false},
+		{"ad3.example.net", true, false},
+		{"10.1.1.1", true, false},
+		{"example.net", false, false},
+	}
+	for _, td := range testData {
+		matched, excepted := l.match(td.host)
+		if matched != td.matched || excepted != td.excepted {
+			t.Errorf("%s match should be %v %v, got %v %v\n",
+				td.host, td.matched, td.excepted, matched, excepted)
+		}
+	}
+}
+
+func TestHostPatternPACRule(t *testing.T) {
+	testData := []struct {
+		pattern string
+		rule    string
+	}{
+		{".example.com", `["s","example.com"]`},
+		{"*.cdn.*", `["w","*.cdn.*"]`},
+		{"/^ad[0-9]+\\./", `["r","^ad[0-9]+\\."]`},
+		{"10.0.0.0/8", `["n","10.0.0.0","255.0.0.0"]`},
+		{"ad[0-9].example.com", ""},
+		{"/(?i)ad/", ""},
+		{"fd00::/8", ""},
+	}
+	for _, td := range testData {
+		hp, err := newHostPattern(td.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rule, ok := hp.pacRule()
+		if ok != (td.rule != "") || rule != td.rule {
+			t.Errorf("%s PAC rule should be %q, got %q\n", td.pattern, td.rule, rule)
+		}
+	}
+}
+
+func TestSiteStatUserRules(t *testing.T) {
+	defer setRaceParent(&fakeParent{server: "127.0.0.1:1"})()
+
+	ss := newSiteStat()
+	ss.loadList(ss.directRules.addRules([]string{"direct.com", "*.cdn.*", "!ads.direct.com"}), userCnt, 0)
+	ss.loadList(ss.blockedRules.addRules([]string{"blocked.com", "!www.blocked.com", "/^blocked[0-9]/"}), 0, userCnt)
+
+	testData := []struct {
+		host    string
+		direct  bool
+		blocked bool
+	}{
+		{"www.direct.com", true, false},
+		{"ads.direct.com", false, false},
+		{"img.cdn.example.com", true, false},
+		{"blocked1.cdn.example.com", false, true}, // blocked rule first
+		{"a.blocked.com", false, true},
+		{"www.blocked.com", false, false},
+		{"example.com", false, false},
+	}
+	for _, td := range testData {
+		url, _ := ParseRequestURI(td.host)
+		vc := ss.GetVisitCnt(url)
+		if vc.AlwaysDirect() != td.direct || vc.AlwaysBlocked() != td.blocked {
+			t.Errorf("%s always direct/blocked should be %v %v\n", td.host, td.direct, td.blocked)
+		}
+	}
+
+	// Learned sites covered by user rules should be removed.
+	ss.Vcnt["img.cdn.example.net"] = newVisitCnt(1, 0)
+	ss.filterSites()
+	if ss.get("img.cdn.example.net") != nil {
+		t.Error("site matching user rule should be filtered")
+	}
+}
+
+func TestGenPACUserRules(t *testing.T) {
+	saved := siteStat
+	defer func() {
+		siteStat = saved
+		updateDirectList()
+	}()
+	siteStat = newSiteStat()
+	siteStat.directRules.addRules([]string{"*.cdn.*", "!ads.cdn.example.com"})
+	siteStat.blockedRules.addRules([]string{"/^blocked/"})
+	updateDirectList()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	c := newClientConn(c1, newHttpProxy("127.0.0.1:7777", "127.0.0.1:7777"))
+	b, _, _ := genPAC(c)
+	pac := string(b)
+	for _, s := range []string{`["w","*.cdn.*"]`, `["s","ads.cdn.example.com"]`, `["r","^blocked"]`} {
+		if !strings.Contains(pac, s) {
+			t.Errorf("PAC should contain rule %s\n", s)
+		}
+	}
+}
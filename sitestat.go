@@ -76,8 +76,13 @@ func (vc *VisitCnt) userSpecified() bool {
 
 const siteStaleThreshold = 10 * 24 * time.Hour
 
+// isStale uses different TTL for learned direct and blocked sites.
 func (vc *VisitCnt) isStale() bool {
-	return time.Now().Sub(time.Time(vc.Recent)) > siteStaleThreshold
+	ttl := blockedSiteTTL
+	if vc.Blocked == 0 {
+		ttl = directSiteTTL
+	}
+	return time.Now().Sub(time.Time(vc.Recent)) > ttl
 }
 
 // shouldNotSave returns true if the a VisitCnt is not visited for a long time
@@ -86,10 +91,10 @@ func (vc *VisitCnt) shouldNotSave() bool {
 	return vc.userSpecified() || vc.isStale() || (vc.Blocked == 0 && vc.Direct == 0)
 }
 
-const tmpBlockedTimeout = 2 * time.Minute
+const defaultTempBlockedTTL = 2 * time.Minute
 
 func (vc *VisitCnt) AsTempBlocked() bool {
-	return time.Now().Sub(vc.blockedOn) < tmpBlockedTimeout
+	return time.Now().Sub(vc.blockedOn) < tempBlockedTTL
 }
 
 func (vc *VisitCnt) AsDirect() bool {
@@ -105,6 +110,11 @@ func (vc *VisitCnt) AsBlocked() bool {
 	return delta >= blockedDelta && rand.Intn(int(delta)) != 0
 }
 
+// mostlyBlocked is AsBlocked without randomness.
+func (vc *VisitCnt) mostlyBlocked() bool {
+	return vc.Blocked == userCnt || vc.AsTempBlocked() || vc.Blocked-vc.Direct >= blockedDelta
+}
+
 func (vc *VisitCnt) AlwaysDirect() bool {
 	return vc.Direct == userCnt
 }
@@ -176,6 +186,19 @@ type SiteStat struct {
 	// direct though it has blocked hosts.
 	hasBlockedHost map[string]bool
 	hbhLock        sync.RWMutex
+
+	// Pattern rules in user specified blocked and direct list.
+	blockedRules siteRuleList
+	directRules  siteRuleList
+
+	// Domains in GFWList, replaced upon reload.
+	gfwlist    *gfwList
+	gfwlistMod time.Time
+	gfwLock    sync.RWMutex
+
+	// Stored in stat file, so time already decayed is not decayed again
+	// when loading. Protected by vcLock.
+	LastDecay time.Time `json:"last_decay"`
 }
 
 func newSiteStat() *SiteStat {
@@ -231,25 +254,90 @@ func (ss *SiteStat) TempBlocked(url *URL) {
 }
 
 var alwaysDirectVisitCnt = newVisitCnt(userCnt, 0)
-
+var alwaysBlockedVisitCnt = newVisitCnt(0, userCnt)
+
+// GetVisitCnt checks the following in order:
+//
+//  1. host in site stat, including hosts in user specified list
+//  2. pattern rules in user specified blocked list, then direct list
+//  3. user specified domain, unless host matches an exception in that list
+//  4. domains in GFWList
+//  5. whether host resolves into direct IP ranges
 func (ss *SiteStat) GetVisitCnt(url *URL) (vcnt *VisitCnt) {
+	vcnt, _ = ss.lookupVisitCnt(url)
+	return
+}
+
+// lookupVisitCnt is GetVisitCnt which also returns how visit count is
+// decided.
+func (ss *SiteStat) lookupVisitCnt(url *URL) (vcnt *VisitCnt, reason string) {
 	if parentProxy.empty() { // no way to retry, so always visit directly
-		return alwaysDirectVisitCnt
+		return alwaysDirectVisitCnt, "no parent proxy"
 	}
 	if url.Domain == "" { // simple host or private ip
-		return alwaysDirectVisitCnt
+		return alwaysDirectVisitCnt, "simple host or private ip"
 	}
 	if vcnt = ss.get(url.Host); vcnt != nil {
-		return
+		if vcnt.userSpecified() {
+			return vcnt, "user specified host"
+		}
+		return vcnt, "learned host"
+	}
+	blocked, blockedExcept := ss.blockedRules.match(url.Host)
+	if blocked {
+		return alwaysBlockedVisitCnt, "blocked rule"
+	}
+	direct, directExcept := ss.directRules.match(url.Host)
+	if direct {
+		return alwaysDirectVisitCnt, "direct rule"
 	}
 	if len(url.Domain) != len(url.Host) {
-		if dmcnt := ss.get(url.Domain); dmcnt != nil && dmcnt.userSpecified() {
+		if dmcnt := ss.get(url.Domain); dmcnt != nil && dmcnt.userSpecified() &&
+			!(blockedExcept && dmcnt.AlwaysBlocked()) &&
+			!(directExcept && dmcnt.AlwaysDirect()) {
 			// if the domain is not specified by user, should create a new host
 			// visitCnt
-			return dmcnt
+			return dmcnt, "user specified domain " + url.Domain
+		}
+	}
+	if vcnt = ss.matchGFWList(url.Host); vcnt != nil {
+		return vcnt, "gfwlist"
+	}
+	if inDirectIP(url.Host) {
+		// Remember as learned direct host to avoid resolving host again.
+		// Blocked detection still applies, so it's retried with parent
+		// proxy if direct connection fails.
+		vcnt = newVisitCnt(directDelta, 0)
+		ss.vcLock.Lock()
+		ss.Vcnt[url.Host] = vcnt
+		ss.vcLock.Unlock()
+		return vcnt, "direct ip range"
+	}
+	return ss.create(url.Host), "new host"
+}
+
+// matchUserRules returns whether host matches pattern rules in user
+// specified lists.
+func (ss *SiteStat) matchUserRules(host string) bool {
+	blocked, _ := ss.blockedRules.match(host)
+	direct, _ := ss.directRules.match(host)
+	return blocked || direct
+}
+
+// learnedStat returns learned sites which should be saved.
+func (ss *SiteStat) learnedStat() *SiteStat {
+	learned := newSiteStat()
+	learned.Update = Date(time.Now())
+	ss.vcLock.RLock()
+	learned.LastDecay = ss.LastDecay
+	for site, vcnt := range ss.Vcnt {
+		if vcnt.shouldNotSave() {
+			continue
 		}
+		learned.Vcnt[site] = vcnt
 	}
-	return ss.create(url.Host)
+	ss.vcLock.RUnlock()
+	return learned
 }
 
 func (ss *SiteStat) store(statPath string) (err error) {
@@ -267,16 +355,7 @@ func (ss *SiteStat) store(statPath string) (err error) {
 			savedSS.Update = Date(now)
 		}
 	} else {
-		savedSS = newSiteStat()
-		savedSS.Update = Date(now)
-		ss.vcLock.RLock()
-		for site, vcnt := range ss.Vcnt {
-			if vcnt.shouldNotSave() {
-				continue
-			}
-			savedSS.Vcnt[site] = vcnt
-		}
-		ss.vcLock.RUnlock()
+		savedSS = ss.learnedStat()
 	}
 
 	b, err := json.MarshalIndent(savedSS, "", "\t")
@@ -322,17 +401,19 @@ func (ss *SiteStat) loadBuiltinList() {
 	ss.loadList(directDomainList, userCnt, 0)
 }
 
+// Besides host and domain, user list can contain pattern rules, refer to
+// siteRuleList.
 func (ss *SiteStat) loadUserList() {
 	if directList, err := loadSiteList(config.DirectFile); err == nil {
-		ss.loadList(directList, userCnt, 0)
+		ss.loadList(ss.directRules.addRules(directList), userCnt, 0)
 	}
 	if blockedList, err := loadSiteList(config.BlockedFile); err == nil {
-		ss.loadList(blockedList, 0, userCnt)
+		ss.loadList(ss.blockedRules.addRules(blockedList), 0, userCnt)
 	}
 }
 
-// Filter sites covered by user specified domains, also filter out stale
-// sites.
+// Filter sites covered by user specified domains, rules and GFWList, also
+// filter out stale sites.
 func (ss *SiteStat) filterSites() {
 	// It's not safe to remove element while iterating over a map.
 	var removeSites []string
@@ -350,9 +431,12 @@ func (ss *SiteStat) filterSites() {
 		var dmcnt *VisitCnt
 		domain := host2Domain(site)
 		if domain != site {
-			dmcnt = ss.get(domain)
+			// Don't use ss.get, taking read lock recursively may deadlock if
+			// there's writer waiting.
+			dmcnt = ss.Vcnt[domain]
 		}
-		if dmcnt != nil && dmcnt.userSpecified() {
+		if (dmcnt != nil && dmcnt.userSpecified()) || ss.matchUserRules(site) ||
+			ss.matchGFWList(site) != nil {
 			removeSites = append(removeSites, site)
 		}
 	}
@@ -371,6 +455,8 @@ func (ss *SiteStat) load(file string) (err error) {
 		// load builtin list first, so user list can override builtin
 		ss.loadBuiltinList()
 		ss.loadUserList()
+		ss.loadGFWList(config.GFWListFile)
+		ss.decay(time.Now())
 		ss.filterSites()
 		for host, vcnt := range ss.Vcnt {
 			if vcnt.OnceBlocked() {
@@ -402,6 +488,11 @@ func (ss *SiteStat) load(file string) (err error) {
 		errl.Println("Error decoding site stat:", err)
 		return
 	}
+	// Decay for the time cow is not running. Stat file written by older
+	// version has no last decay time.
+	if ss.LastDecay.IsZero() {
+		ss.LastDecay = time.Time(ss.Update)
+	}
 	return
 }
 
@@ -413,7 +504,21 @@ func (ss *SiteStat) GetDirectList() []string {
 		if ss.hasBlockedHost[host2Domain(site)] {
 			continue
 		}
-		if vc.AsDirect() {
+		if vc.AsDirect() && ss.matchGFWList(site) != alwaysBlockedVisitCnt {
+			lst = append(lst, site)
+		}
+	}
+	ss.vcLock.RUnlock()
+	return lst
+}
+
+// GetBlockedList returns sites considered blocked, temporarily blocked sites
+// are not included.
+func (ss *SiteStat) GetBlockedList() []string {
+	lst := make([]string, 0)
+	ss.vcLock.RLock()
+	for site, vc := range ss.Vcnt {
+		if vc.AlwaysBlocked() || vc.Blocked-vc.Direct >= blockedDelta {
 			lst = append(lst, site)
 		}
 	}
@@ -424,6 +529,7 @@ func (ss *SiteStat) GetDirectList() []string {
 var siteStat = newSiteStat()
 
 func initSiteStat() {
+	initSiteAging()
 	err := siteStat.load(config.StatFile)
 	if err != nil {
 		// Simply try to load the stat.back, create a new object to avoid error
@@ -442,9 +548,17 @@ func initSiteStat() {
 	go func() {
 		for {
 			time.Sleep(5 * time.Minute)
+			siteStat.decay(time.Now())
 			storeSiteStat(siteStatCont)
 		}
 	}()
+	go reloadGFWList()
+	if config.ReprobeInterval > 0 {
+		go runReprobeBlocked()
+	}
+	if len(config.StatPeer) > 0 {
+		go pullPeerStat()
+	}
 }
 
 const (
@@ -467,6 +581,7 @@ func storeSiteStat(cont byte) {
 	siteStat.store(config.StatFile)
 	if cont == siteStatExit {
 		siteStatFini = true
+		unlockStatFile()
 	}
 }
 
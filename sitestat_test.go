@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -261,3 +262,32 @@ func TestSiteStatGetVisitCnt(t *testing.T) {
 		t.Errorf("%s has one blocked visit, should has once blocked\n", g1.Host)
 	}
 }
+
+func TestFilterSitesConcurrentCreate(t *testing.T) {
+	ss := newSiteStat()
+	ss.Vcnt["example.com"] = newVisitCnt(1, 0)
+	for i := 0; i < 100; i++ {
+		ss.Vcnt[fmt.Sprintf("www%d.example.com", i)] = newVisitCnt(1, 0)
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ {
+			ss.filterSites()
+		}
+		done <- true
+	}()
+	go func() {
+		for i := 0; i < 10000; i++ {
+			ss.create(fmt.Sprintf("site%d.com", i%100))
+		}
+		done <- true
+	}()
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatal("filterSites deadlocked with concurrent create")
+		}
+	}
+}
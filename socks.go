@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SOCKS5 proxy server. Only the CONNECT command is supported. Each accepted
+// connection is converted to an HTTP CONNECT request, so direct/parent
+// selection and blocked site detection work the same as the http listener.
+//
+// Refer to rfc 1928 http://www.ietf.org/rfc/rfc1928.txt and rfc 1929
+// http://www.ietf.org/rfc/rfc1929.txt for the protocol.
+
+const (
+	socksVer5 = 5
+
+	socksMethodNoAuth       = 0
+	socksMethodUserPasswd   = 2
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPasswdVer = 1
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	// Reply field values, messages are in socksError.
+	socksRepSucceeded        = 0
+	socksRepGeneralFailure   = 1
+	socksRepNotAllowed       = 2
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
+var (
+	errSocksVer        = errors.New("socks version not supported")
+	errSocksNoMethod   = errors.New("socks no acceptable authentication method")
+	errSocksAuthFailed = errors.New("socks username/password authentication failed")
+	errSocksCmd        = errors.New("socks command not supported")
+	errSocksAtyp       = errors.New("socks address type not supported")
+)
+
+type socksProxy struct {
+	addr string
+}
+
+func newSocksProxy(addr string) *socksProxy {
+	return &socksProxy{addr}
+}
+
+func (sp *socksProxy) genConfig() string {
+	return fmt.Sprintf("listen = socks5://%s", sp.addr)
+}
+
+func (sp *socksProxy) Addr() string {
+	return sp.addr
+}
+
+func (sp *socksProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer func() {
+		wg.Done()
+	}()
+
+	ln, err := net.Listen("tcp", sp.addr)
+	if err != nil {
+		fmt.Println("listen socks5 failed:", err)
+		return
+	}
+	info.Printf("COW %s socks5 proxy address %s\n", version, sp.addr)
+	var exit bool
+	go func() {
+		<-quit
+		exit = true
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil && !exit {
+			errl.Printf("socks5 proxy(%s) accept %v\n", ln.Addr(), err)
+			if isErrTooManyOpenFd(err) {
+				connPool.CloseAll()
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if exit {
+			debug.Println("exiting socks5 listner")
+			break
+		}
+		c := newClientConn(conn, sp)
+		go c.serveSocks()
+	}
+}
+
+func (c *clientConn) isSocks() bool {
+	_, ok := c.proxy.(*socksProxy)
+	return ok
+}
+
+func (c *clientConn) serveSocks() {
+	var r Request
+	defer func() {
+		r.releaseBuf()
+		c.Close()
+	}()
+
+	if err := c.socksHandshake(&r); err != nil {
+		if err != io.EOF && !isErrConnReset(err) {
+			errl.Printf("cli(%s) socks handshake %v\n", c.RemoteAddr(), err)
+		}
+		return
+	}
+	c.serveTunnel(&r)
+}
+
+// socksHandshake does method selection, authentication and reads the
+// CONNECT request. On success, r is initialized as a HTTP CONNECT request.
+// The reply is sent after connecting to the server, in
+// sendTunnelEstablished or sendSocksError.
+func (c *clientConn) socksHandshake(r *Request) (err error) {
+	c.setReadTimeout("socks handshake")
+	defer c.unsetReadTimeout("socks handshake")
+
+	// version/method selection
+	var b []byte
+	if b, err = c.readSocksField(2); err != nil {
+		return
+	}
+	if b[0] != socksVer5 {
+		return errSocksVer
+	}
+	var methods []byte
+	if methods, err = c.readSocksField(int(b[1])); err != nil {
+		return
+	}
+	method := c.selectSocksMethod(methods)
+	if _, err = c.Write([]byte{socksVer5, method}); err != nil {
+		return
+	}
+	switch method {
+	case socksMethodNoAcceptable:
+		return errSocksNoMethod
+	case socksMethodUserPasswd:
+		if err = c.socksAuthUserPasswd(); err != nil {
+			return
+		}
+	}
+
+	// request
+	if b, err = c.readSocksField(4); err != nil {
+		return
+	}
+	if b[0] != socksVer5 {
+		return errSocksVer
+	}
+	cmd, atyp := b[1], b[3]
+	var host string
+	switch atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		n := net.IPv4len
+		if atyp == socksAtypIPv6 {
+			n = net.IPv6len
+		}
+		if b, err = c.readSocksField(n); err != nil {
+			return
+		}
+		host = net.IP(b).String()
+	case socksAtypDomain:
+		if b, err = c.readSocksField(1); err != nil {
+			return
+		}
+		if b, err = c.readSocksField(int(b[0])); err != nil {
+			return
+		}
+		host = string(b)
+	default:
+		c.writeSocksReply(socksRepAtypNotSupported)
+		return errSocksAtyp
+	}
+	if b, err = c.readSocksField(2); err != nil {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b)))
+
+	if cmd != socksCmdConnect {
+		c.writeSocksReply(socksRepCmdNotSupported)
+		return errSocksCmd
+	}
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		c.writeSocksReply(socksRepHostUnreachable)
+		return fmt.Errorf("socks invalid host %q", host)
+	}
+
+	url := &URL{}
+	url.ParseHostPort(net.JoinHostPort(host, port))
+	initConnectRequest(r, url)
+	return
+}
+
+// readSocksField returns n bytes read from client. The returned slice is
+// only valid until the next read.
+func (c *clientConn) readSocksField(n int) (b []byte, err error) {
+	if n == 0 {
+		return nil, nil
+	}
+	if b, err = c.bufRd.Peek(n); err != nil {
+		if isErrTimeout(err) {
+			return nil, errClientTimeout
+		}
+		return nil, err
+	}
+	c.bufRd.Skip(n)
+	return
+}
+
+func (c *clientConn) selectSocksMethod(methods []byte) byte {
+	var noAuth, userPasswd bool
+	for _, m := range methods {
+		switch m {
+		case socksMethodNoAuth:
+			noAuth = true
+		case socksMethodUserPasswd:
+			userPasswd = true
+		}
+	}
+	if !auth.required || c.socksIPAuthed() {
+		if noAuth {
+			return socksMethodNoAuth
+		}
+	}
+	if auth.required && len(auth.user) > 0 && userPasswd {
+		return socksMethodUserPasswd
+	}
+	return socksMethodNoAcceptable
+}
+
+// socksIPAuthed returns true if the client does not need username/password
+// authentication because of its IP address.
+func (c *clientConn) socksIPAuthed() bool {
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	return auth.authed.has(clientIP) || authIP(clientIP)
+}
+
+// socksAuthUserPasswd does username/password authentication using the users
+// specified in userPasswd and userPasswdFile.
+func (c *clientConn) socksAuthUserPasswd() (err error) {
+	var b []byte
+	if b, err = c.readSocksField(2); err != nil {
+		return
+	}
+	if b[0] != socksUserPasswdVer {
+		return errSocksVer
+	}
+	if b, err = c.readSocksField(int(b[1])); err != nil {
+		return
+	}
+	user := string(b)
+	if b, err = c.readSocksField(1); err != nil {
+		return
+	}
+	if b, err = c.readSocksField(int(b[0])); err != nil {
+		return
+	}
+	passwd := string(b)
+
+	au, ok := auth.user[user]
+	if !ok || au.passwd != passwd || authPort(c, user, au) != nil {
+		c.Write([]byte{socksUserPasswdVer, 1})
+		return errSocksAuthFailed
+	}
+	if _, err = c.Write([]byte{socksUserPasswdVer, 0}); err != nil {
+		return
+	}
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	auth.authed.add(clientIP)
+	return
+}
+
+// initConnectRequest makes r look like a CONNECT request returned by
+// parseRequest, so it can be sent to http and cow parent proxies.
+func initConnectRequest(r *Request, url *URL) {
+	r.reset()
+	r.Method = "CONNECT"
+	r.URL = url
+	r.Header.Host = url.HostPort
+	r.isConnect = true
+	if config.saveReqLine {
+		r.raw.WriteString("CONNECT " + url.HostPort + " HTTP/1.1\r\n")
+		r.reqLnStart = r.raw.Len()
+	}
+	r.headStart = r.raw.Len()
+	r.raw.WriteString("Host: " + url.HostPort + CRLF)
+	r.raw.WriteString(fullHeaderConnectionKeepAlive)
+	r.raw.WriteString(CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
+// writeSocksReply sends reply with zero bound address. Clients use the
+// reply only to know whether the connection is established.
+func (c *clientConn) writeSocksReply(rep byte) (err error) {
+	_, err = c.Write([]byte{socksVer5, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	c.socksReplied = true
+	return
+}
+
+// sendSocksError is called instead of sending error page to SOCKS clients.
+// It only sends reply if no reply is sent before.
+func (c *clientConn) sendSocksError(codeReason string) {
+	if c.socksReplied {
+		return
+	}
+	rep := byte(socksRepGeneralFailure)
+	switch {
+	case strings.HasPrefix(codeReason, "403"):
+		rep = socksRepNotAllowed
+	case strings.HasPrefix(codeReason, "504"):
+		rep = socksRepHostUnreachable
+	}
+	c.writeSocksReply(rep)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	testData := []struct {
+		req      []byte // method selection followed by request
+		hostPort string
+		rep      []byte // expected data sent to client, nil means same as method selection reply
+	}{
+		{[]byte{5, 1, 0, 5, 1, 0, 3, 9, 'g', 'o', 'o', 'g', 'l', 'e', '.', 'h', 'k', 0, 80},
+			"google.hk:80", nil},
+		{[]byte{5, 2, 2, 0, 5, 1, 0, 1, 8, 8, 4, 4, 1, 187},
+			"8.8.4.4:443", nil},
+		{[]byte{5, 1, 0, 5, 1, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22},
+			"[::1]:22", nil},
+		// bind command not supported
+		{[]byte{5, 1, 0, 5, 2, 0, 1, 1, 2, 3, 4, 0, 80},
+			"", []byte{5, 0, 5, socksRepCmdNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}},
+		// only username/password method offered when no auth required
+		{[]byte{5, 1, 2},
+			"", []byte{5, socksMethodNoAcceptable}},
+	}
+
+	for _, td := range testData {
+		cli, srv := net.Pipe()
+		c := newClientConn(srv, newSocksProxy("127.0.0.1:1080"))
+		go cli.Write(td.req)
+
+		var got bytes.Buffer
+		done := make(chan struct{})
+		go func() {
+			io.Copy(&got, cli)
+			close(done)
+		}()
+
+		var r Request
+		err := c.socksHandshake(&r)
+		srv.Close()
+		<-done
+		cli.Close()
+
+		if td.hostPort == "" {
+			if err == nil {
+				t.Errorf("%v should return error\n", td.req)
+			}
+			if !bytes.Equal(got.Bytes(), td.rep) {
+				t.Errorf("%v reply should be %v, got %v\n", td.req, td.rep, got.Bytes())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v unexpected error %v\n", td.req, err)
+			continue
+		}
+		if !bytes.Equal(got.Bytes(), []byte{5, 0}) {
+			t.Errorf("%v method selection reply wrong, got %v\n", td.req, got.Bytes())
+		}
+		if !r.isConnect || r.URL.HostPort != td.hostPort {
+			t.Errorf("%v should request %s, got %s\n", td.req, td.hostPort, r.URL.HostPort)
+		}
+		r.releaseBuf()
+	}
+}
+
+func TestInitConnectRequest(t *testing.T) {
+	saved := config.saveReqLine
+	config.saveReqLine = true
+	defer func() {
+		config.saveReqLine = saved
+	}()
+
+	url := &URL{}
+	url.ParseHostPort("www.g.com:443")
+	var r Request
+	initConnectRequest(&r, url)
+	defer r.releaseBuf()
+
+	if string(r.proxyRequestLine()) != "CONNECT www.g.com:443 HTTP/1.1\r\n" {
+		t.Errorf("CONNECT request line wrong, got %q\n", r.proxyRequestLine())
+	}
+	const header = "Host: www.g.com:443\r\nConnection: keep-alive\r\n\r\n"
+	if string(r.rawHeaderBody()) != header {
+		t.Errorf("CONNECT request header wrong, got %q\n", r.rawHeaderBody())
+	}
+	if len(r.rawBody()) != 0 {
+		t.Errorf("CONNECT request should have no body, got %q\n", r.rawBody())
+	}
+}
+
+func TestSocksParentAuth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(c, b); err != nil ||
+					!bytes.Equal(b, []byte{5, 2, socksMethodNoAuth, socksMethodUserPasswd}) {
+					return
+				}
+				c.Write([]byte{5, socksMethodUserPasswd})
+				// ver, ulen, "user", plen, "passwd"
+				b = make([]byte, 2+4+1+6)
+				if _, err := io.ReadFull(c, b); err != nil {
+					return
+				}
+				if string(b[2:6]) != "user" || string(b[7:]) != "passwd" {
+					c.Write([]byte{socksUserPasswdVer, 1})
+					return
+				}
+				c.Write([]byte{socksUserPasswdVer, 0})
+				// request for example.com:80
+				b = make([]byte, 5+len("example.com")+2)
+				if _, err := io.ReadFull(c, b); err != nil {
+					return
+				}
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			}()
+		}
+	}()
+
+	url := &URL{HostPort: "example.com:80", Host: "example.com", Port: "80"}
+	sp := newSocksParent(ln.Addr().String())
+	sp.initAuth("user", "passwd")
+	c, err := sp.connect(url)
+	if err != nil {
+		t.Fatal("socks parent auth failed:", err)
+	}
+	c.Close()
+
+	sp.initAuth("user", "wrong!")
+	if _, err = sp.connect(url); err == nil {
+		t.Error("socks parent auth with wrong password should fail")
+	} else if !strings.Contains(err.Error(), "authentication failed") {
+		t.Error("socks parent auth error not clear:", err)
+	}
+}
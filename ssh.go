@@ -1,10 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func SshRunning(socksServer string) bool {
@@ -51,3 +59,395 @@ func runSSH() {
 		go runOneSSH(server)
 	}
 }
+
+// ssh parent proxy. Connections to web servers are opened as direct-tcpip
+// channels over a single ssh connection, which is re-established with
+// exponential backoff if broken.
+type sshParent struct {
+	server  string // host:port
+	user    string
+	passwd  string // for upgrade config
+	options string // raw query string, for upgrade config
+	config  *ssh.ClientConfig
+
+	mu        sync.Mutex
+	client    *ssh.Client
+	lastErr   error
+	backoff   time.Duration
+	retryTime time.Time
+}
+
+type sshConn struct {
+	net.Conn
+	parent *sshParent
+}
+
+func (s sshConn) String() string {
+	return "ssh parent proxy " + s.parent.server
+}
+
+type sshTimeoutError struct{}
+
+func (e sshTimeoutError) Error() string   { return "ssh channel i/o timeout" }
+func (e sshTimeoutError) Timeout() bool   { return true }
+func (e sshTimeoutError) Temporary() bool { return true }
+
+// sshChanConn adds deadline support to ssh channel, which does not support
+// deadline by itself. Channel is read in another goroutine, so Read can
+// return on read deadline without losing data. Write can't be cancelled, so
+// the channel is closed if write is still blocked on write deadline.
+type sshChanConn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte // data read from channel but not returned yet
+	err       error
+	reading   bool
+	rdeadline time.Time
+	rtimer    *time.Timer
+	wdeadline time.Time
+	wtimer    *time.Timer
+	writing   int
+}
+
+func newSshChanConn(c net.Conn) *sshChanConn {
+	sc := &sshChanConn{Conn: c}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+func (sc *sshChanConn) Read(b []byte) (n int, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for len(sc.buf) == 0 {
+		if sc.err != nil {
+			return 0, sc.err
+		}
+		if !sc.rdeadline.IsZero() && !time.Now().Before(sc.rdeadline) {
+			return 0, sshTimeoutError{}
+		}
+		if !sc.reading {
+			sc.reading = true
+			go sc.fill(len(b))
+		}
+		sc.cond.Wait()
+	}
+	n = copy(b, sc.buf)
+	sc.buf = sc.buf[n:]
+	return n, nil
+}
+
+// fill reads from channel, result is taken by Read.
+func (sc *sshChanConn) fill(size int) {
+	buf := make([]byte, size)
+	n, err := sc.Conn.Read(buf)
+	sc.mu.Lock()
+	sc.buf = buf[:n]
+	sc.err = err
+	sc.reading = false
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+}
+
+func (sc *sshChanConn) Write(b []byte) (int, error) {
+	sc.mu.Lock()
+	if !sc.wdeadline.IsZero() && !time.Now().Before(sc.wdeadline) {
+		sc.mu.Unlock()
+		return 0, sshTimeoutError{}
+	}
+	sc.writing++
+	sc.mu.Unlock()
+	n, err := sc.Conn.Write(b)
+	sc.mu.Lock()
+	sc.writing--
+	sc.mu.Unlock()
+	return n, err
+}
+
+func (sc *sshChanConn) writeTimeout() {
+	sc.mu.Lock()
+	blocked := sc.writing > 0
+	sc.mu.Unlock()
+	if blocked {
+		sc.Conn.Close()
+	}
+}
+
+func (sc *sshChanConn) wakeup() {
+	sc.mu.Lock()
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+}
+
+func (sc *sshChanConn) SetReadDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.rdeadline = t
+	if sc.rtimer != nil {
+		sc.rtimer.Stop()
+		sc.rtimer = nil
+	}
+	if !t.IsZero() {
+		sc.rtimer = time.AfterFunc(t.Sub(time.Now()), sc.wakeup)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *sshChanConn) SetWriteDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.wdeadline = t
+	if sc.wtimer != nil {
+		sc.wtimer.Stop()
+		sc.wtimer = nil
+	}
+	if !t.IsZero() {
+		sc.wtimer = time.AfterFunc(t.Sub(time.Now()), sc.writeTimeout)
+	}
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *sshChanConn) SetDeadline(t time.Time) error {
+	sc.SetReadDeadline(t)
+	return sc.SetWriteDeadline(t)
+}
+
+func (sc *sshChanConn) Close() error {
+	sc.mu.Lock()
+	if sc.rtimer != nil {
+		sc.rtimer.Stop()
+	}
+	if sc.wtimer != nil {
+		sc.wtimer.Stop()
+	}
+	sc.mu.Unlock()
+	return sc.Conn.Close()
+}
+
+const (
+	sshMinBackoff        = time.Second
+	sshMaxBackoff        = time.Minute
+	sshKeepAliveInterval = 30 * time.Second
+)
+
+func newSshParent(server, user string) *sshParent {
+	return &sshParent{
+		server: server,
+		user:   user,
+		config: &ssh.ClientConfig{User: user},
+	}
+}
+
+func (sp *sshParent) getServer() string {
+	return sp.server
+}
+
+func (sp *sshParent) genConfig() string {
+	cfg := "proxy = ssh://" + sp.user
+	if sp.passwd != "" {
+		cfg += ":" + sp.passwd
+	}
+	cfg += "@" + sp.server
+	if sp.options != "" {
+		cfg += "?" + sp.options
+	}
+	return cfg
+}
+
+// initAuth sets up authentication methods and host key verification. Default
+// private keys in ~/.ssh are used if no key file and password is given.
+func (sp *sshParent) initAuth(passwd, keyFile, knownHostsFile string) error {
+	sp.passwd = passwd
+	var keyFiles []string
+	if keyFile != "" {
+		keyFiles = []string{keyFile}
+	} else if passwd == "" {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			f := filepath.Join(getUserHomeDir(), ".ssh", name)
+			if isFileExists(f) == nil {
+				keyFiles = append(keyFiles, f)
+			}
+		}
+		if len(keyFiles) == 0 {
+			return errors.New("no private key found in ~/.ssh, specify key or password")
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, f := range keyFiles {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return fmt.Errorf("private key %s: %v", f, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		sp.config.Auth = append(sp.config.Auth, ssh.PublicKeys(signers...))
+	}
+	if passwd != "" {
+		sp.config.Auth = append(sp.config.Auth, ssh.Password(passwd))
+	}
+
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(getUserHomeDir(), ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("known hosts: %v", err)
+	}
+	sp.config.HostKeyCallback = hostKeyCallback
+	return nil
+}
+
+// state reports ssh connection state for logging.
+func (sp *sshParent) state() string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.client != nil {
+		return "connected"
+	}
+	if sp.lastErr == nil {
+		return "not connected"
+	}
+	if wait := sp.retryTime.Sub(time.Now()); wait > 0 {
+		return fmt.Sprintf("disconnected (%v), reconnect in %v", sp.lastErr, wait)
+	}
+	return fmt.Sprintf("disconnected (%v)", sp.lastErr)
+}
+
+func (sp *sshParent) connect(url *URL) (net.Conn, error) {
+	// The ssh connection may be found broken when opening channel, try again
+	// with a new connection in that case.
+	for i := 0; ; i++ {
+		client, err := sp.getClient()
+		if err != nil {
+			errl.Printf("can't connect to ssh parent %s for %s, %s\n",
+				sp.server, url.HostPort, sp.state())
+			return nil, err
+		}
+		c, err := client.Dial("tcp", url.HostPort)
+		if err == nil {
+			debug.Println("connected to:", url.HostPort, "via ssh parent:", sp.server)
+			return sshConn{newSshChanConn(c), sp}, nil
+		}
+		// Server refused to open channel, the ssh connection is still usable.
+		_, refused := err.(*ssh.OpenChannelError)
+		if !refused {
+			sp.disconnect(client, err)
+		}
+		if refused {
+			errl.Printf("ssh parent %s can't connect to %s: %v\n",
+				sp.server, url.HostPort, err)
+			return nil, targetError{err}
+		}
+		if i > 0 {
+			errl.Printf("ssh parent %s can't connect to %s: %v\n",
+				sp.server, url.HostPort, err)
+			return nil, err
+		}
+	}
+}
+
+// getClient returns the ssh connection, creates one if not connected. Fails
+// immediately if the last connection attempt failed not long ago.
+func (sp *sshParent) getClient() (*ssh.Client, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.client != nil {
+		return sp.client, nil
+	}
+	if wait := sp.retryTime.Sub(time.Now()); wait > 0 {
+		return nil, fmt.Errorf("last error %v, reconnect in %v", sp.lastErr, wait)
+	}
+
+	client, err := sp.dial()
+	if err != nil {
+		if sp.backoff == 0 {
+			sp.backoff = sshMinBackoff
+		} else if sp.backoff *= 2; sp.backoff > sshMaxBackoff {
+			sp.backoff = sshMaxBackoff
+		}
+		sp.lastErr = err
+		sp.retryTime = time.Now().Add(sp.backoff)
+		errl.Printf("ssh parent %s connect failed: %v, reconnect in %v\n",
+			sp.server, err, sp.backoff)
+		return nil, err
+	}
+	info.Printf("ssh parent %s connected\n", sp.server)
+	sp.client = client
+	sp.lastErr = nil
+	sp.backoff = 0
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		sp.disconnect(client, err)
+	}()
+	go sp.keepAlive(client)
+	return client, nil
+}
+
+func (sp *sshParent) dial() (*ssh.Client, error) {
+	c, err := net.DialTimeout("tcp", sp.server, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	conn, chans, reqs, err := ssh.NewClientConn(c, sp.server, sp.config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(zeroTime)
+	return ssh.NewClient(conn, chans, reqs), nil
+}
+
+// disconnect closes client if it's still in use. Next connect will create
+// new ssh connection.
+func (sp *sshParent) disconnect(client *ssh.Client, err error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.client != client {
+		return
+	}
+	errl.Printf("ssh parent %s disconnected: %v\n", sp.server, err)
+	sp.client = nil
+	sp.lastErr = err
+	client.Close()
+}
+
+// keepAlive detects broken ssh connection which may not be noticed when
+// there's no traffic.
+func (sp *sshParent) keepAlive(client *ssh.Client) {
+	for {
+		time.Sleep(sshKeepAliveInterval)
+		sp.mu.Lock()
+		using := sp.client == client
+		sp.mu.Unlock()
+		if !using {
+			return
+		}
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				sp.disconnect(client, err)
+				return
+			}
+		case <-time.After(dialTimeout):
+			sp.disconnect(client, errors.New("keepalive timeout"))
+			return
+		}
+	}
+}
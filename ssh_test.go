@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer accepts public key authentication for user cow and forwards
+// direct-tcpip channels.
+type testSSHServer struct {
+	ln      net.Listener
+	config  *ssh.ServerConfig
+	hostKey ssh.PublicKey
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newTestSSHServer(t *testing.T, clientKey ssh.PublicKey) *testSSHServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "cow" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testSSHServer{ln: ln, config: config, hostKey: signer.PublicKey()}
+	go srv.serve()
+	return srv
+}
+
+func (srv *testSSHServer) serve() {
+	for {
+		c, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, chans, reqs, err := ssh.NewServerConn(c, srv.config)
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				go forwardDirectTCPIP(nc)
+			}
+		}()
+	}
+}
+
+// closeConns breaks all established ssh connections.
+func (srv *testSSHServer) closeConns() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.conns {
+		c.Close()
+	}
+	srv.conns = nil
+}
+
+func forwardDirectTCPIP(nc ssh.NewChannel) {
+	if nc.ChannelType() != "direct-tcpip" {
+		nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+		return
+	}
+	// host string, port uint32, originator host string, originator port uint32
+	data := nc.ExtraData()
+	n := binary.BigEndian.Uint32(data)
+	host := string(data[4 : 4+n])
+	port := binary.BigEndian.Uint32(data[4+n:])
+	c, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(c, ch)
+		c.Close()
+	}()
+	io.Copy(ch, c)
+	ch.Close()
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func checkEcho(t *testing.T, c net.Conn) {
+	const msg = "hello through ssh"
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal("write to ssh channel:", err)
+	}
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal("read from ssh channel:", err)
+	}
+	if string(b) != msg {
+		t.Errorf("echo got %q\n", b)
+	}
+}
+
+func TestSshParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newTestSSHServer(t, clientKey)
+	defer srv.ln.Close()
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{srv.ln.Addr().String()}, srv.hostKey)
+	if err = ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	url := &URL{HostPort: echo.Addr().String()}
+
+	sp := newSshParent(srv.ln.Addr().String(), "cow")
+	if err = sp.initAuth("", keyFile, knownHostsFile); err != nil {
+		t.Fatal("init ssh auth:", err)
+	}
+	c, err := sp.connect(url)
+	if err != nil {
+		t.Fatal("connect via ssh parent:", err)
+	}
+	checkEcho(t, c)
+	client := sp.client
+
+	// channels share the same ssh connection
+	c2, err := sp.connect(url)
+	if err != nil {
+		t.Fatal("connect via ssh parent:", err)
+	}
+	checkEcho(t, c2)
+	if sp.client != client {
+		t.Error("should reuse ssh connection")
+	}
+	c.Close()
+	c2.Close()
+	if sp.state() != "connected" {
+		t.Error("state should be connected, got", sp.state())
+	}
+
+	// reconnect after ssh connection broken
+	srv.closeConns()
+	client.Wait()
+	if c, err = sp.connect(url); err != nil {
+		t.Fatal("reconnect via ssh parent:", err)
+	}
+	checkEcho(t, c)
+	c.Close()
+
+	// wait before reconnect after connection failure
+	srv.closeConns()
+	srv.ln.Close()
+	sp.client.Wait()
+	if _, err = sp.connect(url); err == nil {
+		t.Fatal("connect should fail after ssh server stopped")
+	}
+	if _, err = sp.connect(url); err == nil || !strings.Contains(err.Error(), "reconnect in") {
+		t.Error("should not reconnect immediately after failure, got:", err)
+	}
+	if !strings.Contains(sp.state(), "disconnected") {
+		t.Error("state should be disconnected, got", sp.state())
+	}
+}
+
+func TestSshParentHostKeyMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	clientKey, _ := ssh.NewPublicKey(&key.PublicKey)
+
+	srv := newTestSSHServer(t, clientKey)
+	defer srv.ln.Close()
+	// client key is not the server's host key
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{srv.ln.Addr().String()}, clientKey)
+	ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600)
+
+	sp := newSshParent(srv.ln.Addr().String(), "cow")
+	if err = sp.initAuth("", keyFile, knownHostsFile); err != nil {
+		t.Fatal("init ssh auth:", err)
+	}
+	if _, err = sp.connect(&URL{HostPort: "127.0.0.1:80"}); err == nil {
+		t.Error("should fail with mismatched host key")
+	}
+}
+
+func TestSshChanConnDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	sc := newSshChanConn(c1)
+	defer sc.Close()
+
+	buf := make([]byte, 5)
+	sc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := sc.Read(buf); !isErrTimeout(err) {
+		t.Fatal("read should time out, got", err)
+	}
+	// Data arriving after timeout should not be lost.
+	go c2.Write([]byte("hello"))
+	sc.SetReadDeadline(zeroTime)
+	if n, err := io.ReadFull(sc, buf); err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("read after timeout got %q %v\n", buf[:n], err)
+	}
+
+	sc.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := sc.Write([]byte("blocked")); err == nil {
+		t.Error("blocked write should fail on write deadline")
+	}
+}
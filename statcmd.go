@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "cow stat" subcommand inspects and edits site stat file. Running cow
+// stores site stat periodically and on exit, which would overwrite changes
+// made by this command, so editing is refused if cow is running.
+
+const statCmdUsage = `Usage: cow stat [-rc config] [-force] command
+
+Commands:
+  list                      list hosts in site stat
+  show <host>               show visit count of host
+  set <host> direct|blocked mark host as direct or blocked
+  reset <host>              remove host from site stat
+  prune                     remove stale sites and sites covered by user lists
+  export                    print learned sites in stat file format
+  merge <file|url>          merge learned sites from stat file or peer cow
+
+Options:
+`
+
+func runStatCmd(args []string) int {
+	fs := flag.NewFlagSet("stat", flag.ContinueOnError)
+	rcFile := fs.String("rc", "", "config file, defaults to $HOME/.cow/rc on Unix, ./rc.txt on Windows")
+	force := fs.Bool("force", false, "edit site stat even if cow is running")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, statCmdUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	rc := *rcFile
+	if rc == "" {
+		rc = getDefaultRcFile()
+	} else {
+		rc = expandTilde(rc)
+	}
+	if err := isFileExists(rc); err != nil {
+		Fatal("fail to get config file:", err)
+	}
+	initConfig(rc)
+	parseConfig(rc, &Config{})
+	initSiteAging()
+
+	cmd := fs.Arg(0)
+	if statCmdModifies(cmd) && !*force {
+		if pid, running := statFileOwner(config.StatFile); running {
+			fmt.Fprintf(os.Stderr, "cow (pid %d) is running and will overwrite changes to %s,\n"+
+				"stop it first or use -force\n", pid, config.StatFile)
+			return 1
+		}
+	}
+
+	ss := newSiteStat()
+	if err := ss.load(config.StatFile); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "load site stat:", err)
+		return 1
+	}
+	if err := ss.runCmd(os.Stdout, cmd, fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if statCmdModifies(cmd) {
+		if err := ss.store(config.StatFile); err != nil {
+			fmt.Fprintln(os.Stderr, "store site stat:", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func statCmdModifies(cmd string) bool {
+	return cmd == "set" || cmd == "reset" || cmd == "prune" || cmd == "merge"
+}
+
+var errStatCmdArg = errors.New("wrong number of arguments, run \"cow stat\" for usage")
+
+// runCmd executes the stat command on the loaded site stat. Caller should
+// store site stat for commands modifying it.
+func (ss *SiteStat) runCmd(w io.Writer, cmd string, args []string) error {
+	nargs := map[string]int{"list": 0, "show": 1, "set": 2, "reset": 1, "prune": 0,
+		"export": 0, "merge": 1}
+	n, ok := nargs[cmd]
+	if !ok {
+		return fmt.Errorf("unknown stat command %s", cmd)
+	}
+	if len(args) != n {
+		return errStatCmdArg
+	}
+
+	switch cmd {
+	case "list":
+		ss.list(w)
+	case "show":
+		vc := ss.get(args[0])
+		if vc == nil {
+			return fmt.Errorf("%s not in site stat", args[0])
+		}
+		printVisitCnt(w, args[0], vc)
+	case "set":
+		var vc *VisitCnt
+		switch args[1] {
+		case "direct":
+			vc = newVisitCnt(maxCnt, 0)
+		case "blocked":
+			vc = newVisitCnt(0, maxCnt)
+		default:
+			return fmt.Errorf("%s should be direct or blocked", args[1])
+		}
+		if old := ss.get(args[0]); old != nil && old.userSpecified() {
+			return fmt.Errorf("%s is specified in blocked/direct list", args[0])
+		}
+		ss.vcLock.Lock()
+		ss.Vcnt[args[0]] = vc
+		ss.vcLock.Unlock()
+	case "reset":
+		vc := ss.get(args[0])
+		if vc == nil || vc.userSpecified() {
+			return fmt.Errorf("%s not in site stat", args[0])
+		}
+		ss.vcLock.Lock()
+		delete(ss.Vcnt, args[0])
+		ss.vcLock.Unlock()
+	case "prune":
+		fmt.Fprintf(w, "pruned %d sites\n", ss.prune())
+	case "export":
+		return ss.export(w)
+	case "merge":
+		other, err := fetchSiteStat(args[0])
+		if err != nil {
+			return err
+		}
+		added, updated := ss.merge(other)
+		fmt.Fprintf(w, "%d added, %d updated\n", added, updated)
+	}
+	return nil
+}
+
+// list prints hosts in site stat, sorted by host. User specified sites are
+// not included.
+func (ss *SiteStat) list(w io.Writer) {
+	ss.vcLock.RLock()
+	defer ss.vcLock.RUnlock()
+	hosts := make([]string, 0, len(ss.Vcnt))
+	for host, vc := range ss.Vcnt {
+		if !vc.userSpecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		vc := ss.Vcnt[host]
+		fmt.Fprintf(w, "%-40s direct %3d  blocked %3d  recent %s\n", host, vc.Direct, vc.Blocked,
+			time.Time(vc.Recent).Format(dateLayout))
+	}
+}
+
+func printVisitCnt(w io.Writer, host string, vc *VisitCnt) {
+	fmt.Fprintln(w, "host:", host)
+	if vc.AlwaysDirect() {
+		fmt.Fprintln(w, "user specified: direct")
+		return
+	}
+	if vc.AlwaysBlocked() {
+		fmt.Fprintln(w, "user specified: blocked")
+		return
+	}
+	fmt.Fprintln(w, "direct:", vc.Direct)
+	fmt.Fprintln(w, "blocked:", vc.Blocked)
+	fmt.Fprintln(w, "recent:", time.Time(vc.Recent).Format(dateLayout))
+	fmt.Fprintln(w, "as direct:", vc.AsDirect())
+	fmt.Fprintln(w, "stale:", vc.isStale())
+}
+
+// prune removes sites that will not be saved and sites covered by user
+// lists. Returns the number of removed sites.
+func (ss *SiteStat) prune() int {
+	ss.vcLock.Lock()
+	before := len(ss.Vcnt)
+	for site, vc := range ss.Vcnt {
+		if !vc.userSpecified() && vc.shouldNotSave() {
+			delete(ss.Vcnt, site)
+		}
+	}
+	ss.vcLock.Unlock()
+	ss.filterSites()
+	return before - len(ss.Vcnt)
+}
+
+// Running cow writes its pid to lock file next to stat file.
+
+func statLockPath(statFile string) string {
+	return statFile + ".lock"
+}
+
+func lockStatFile() {
+	if config.StatFile == "" {
+		return
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := ioutil.WriteFile(statLockPath(config.StatFile), pid, 0644); err != nil {
+		errl.Println("Error creating stat lock file:", err)
+	}
+}
+
+func unlockStatFile() {
+	if config.StatFile != "" {
+		os.Remove(statLockPath(config.StatFile))
+	}
+}
+
+// statFileOwner returns pid of running cow which owns stat file.
+func statFileOwner(statFile string) (pid int, running bool) {
+	b, err := ioutil.ReadFile(statLockPath(statFile))
+	if err != nil {
+		return 0, false
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid == os.Getpid() {
+		return pid, false
+	}
+	return pid, isProcessRunning(pid)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiteStatCmd(t *testing.T) {
+	ss := newSiteStat()
+	ss.loadList([]string{"user.com"}, userCnt, 0)
+	ss.Vcnt["b.com"] = newVisitCnt(0, 3)
+	ss.Vcnt["a.com"] = newVisitCnt(2, 0)
+	ss.Vcnt["stale.com"] = newVisitCntWithTime(2, 0, time.Now().Add(-2*siteStaleThreshold))
+
+	run := func(cmd string, args ...string) (string, error) {
+		var buf bytes.Buffer
+		err := ss.runCmd(&buf, cmd, args)
+		return buf.String(), err
+	}
+
+	out, err := run("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "a.com ") || !strings.HasPrefix(lines[1], "b.com ") {
+		t.Errorf("list should be sorted and not include user specified sites, got:\n%s", out)
+	}
+
+	if out, err = run("show", "b.com"); err != nil || !strings.Contains(out, "blocked: 3") {
+		t.Errorf("show b.com got %q %v\n", out, err)
+	}
+	if _, err = run("show", "c.com"); err == nil {
+		t.Error("show site not in stat should return error")
+	}
+
+	if _, err = run("set", "c.com", "blocked"); err != nil {
+		t.Fatal(err)
+	}
+	if vc := ss.get("c.com"); vc == nil || !vc.OnceBlocked() || vc.AsDirect() {
+		t.Error("c.com should be set as blocked")
+	}
+	if _, err = run("set", "a.com", "direct"); err != nil || ss.get("a.com").Direct != maxCnt {
+		t.Error("a.com should be set as direct")
+	}
+	if _, err = run("set", "user.com", "blocked"); err == nil {
+		t.Error("setting user specified site should return error")
+	}
+	if _, err = run("set", "c.com", "foo"); err == nil {
+		t.Error("invalid set value should return error")
+	}
+
+	if _, err = run("reset", "b.com"); err != nil || ss.get("b.com") != nil {
+		t.Error("reset should remove b.com")
+	}
+	if _, err = run("reset", "user.com"); err == nil {
+		t.Error("reset user specified site should return error")
+	}
+
+	if out, err = run("prune"); err != nil || out != "pruned 1 sites\n" || ss.get("stale.com") != nil {
+		t.Errorf("prune should remove stale site, got %q %v\n", out, err)
+	}
+
+	if _, err = run("show"); err != errStatCmdArg {
+		t.Error("wrong number of arguments should return error")
+	}
+	if _, err = run("foo"); err == nil {
+		t.Error("unknown command should return error")
+	}
+}
+
+func TestStatFileOwner(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cow-statlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	statFile := path.Join(tmpDir, "stat")
+
+	if _, running := statFileOwner(statFile); running {
+		t.Error("no lock file, should not be running")
+	}
+	// Parent process of test is running.
+	ioutil.WriteFile(statLockPath(statFile), []byte(strconv.Itoa(os.Getppid())), 0644)
+	if pid, running := statFileOwner(statFile); !running || pid != os.Getppid() {
+		t.Error("owner of stat file should be running")
+	}
+	ioutil.WriteFile(statLockPath(statFile), []byte("foo"), 0644)
+	if _, running := statFileOwner(statFile); running {
+		t.Error("invalid lock file should be ignored")
+	}
+}
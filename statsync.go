@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nethttp "net/http" // http is used for http parent config
+	"strings"
+	"time"
+)
+
+// Learned site stat can be exported and merged into another cow instance,
+// either with "cow stat merge" or by pulling from peer cow's /stat URL
+// periodically, so sites learned by one instance don't need to be learned
+// again through timeouts.
+
+const (
+	statPeerTimeout         = 30 * time.Second
+	defaultStatPeerInterval = time.Hour
+)
+
+// mergeVisitCnt merges other into vc. More recent visit count wins, counts
+// are merged by taking the larger one if both are visited on the same day.
+// Returns whether vc is changed.
+func mergeVisitCnt(vc, other *VisitCnt) bool {
+	// Recent loaded from file only has date, so compare by date.
+	recent := time.Time(vc.Recent).Format(dateLayout)
+	otherRecent := time.Time(other.Recent).Format(dateLayout)
+	switch {
+	case otherRecent > recent:
+		vc.Direct, vc.Blocked = other.Direct, other.Blocked
+		visitLock.Lock()
+		vc.Recent = other.Recent
+		visitLock.Unlock()
+		return true
+	case otherRecent == recent:
+		changed := false
+		if other.Direct > vc.Direct {
+			vc.Direct = other.Direct
+			changed = true
+		}
+		if other.Blocked > vc.Blocked {
+			vc.Blocked = other.Blocked
+			changed = true
+		}
+		return changed
+	}
+	return false
+}
+
+// merge merges learned sites in other into ss. Sites specified by user are
+// not changed. Returns the number of added and updated sites.
+func (ss *SiteStat) merge(other *SiteStat) (added, updated int) {
+	var merged []string
+	for site, ovc := range other.Vcnt {
+		if ovc.shouldNotSave() {
+			continue
+		}
+		ss.vcLock.Lock()
+		vc := ss.Vcnt[site]
+		if vc == nil {
+			cp := *ovc
+			ss.Vcnt[site] = &cp
+			added++
+			merged = append(merged, site)
+		} else if !vc.userSpecified() && mergeVisitCnt(vc, ovc) {
+			updated++
+			merged = append(merged, site)
+		}
+		ss.vcLock.Unlock()
+	}
+	// Remove merged sites covered by user specified domains and rules.
+	ss.filterSites()
+	// Same as load, so domain of blocked host is not put in PAC direct list.
+	for _, site := range merged {
+		if vc := ss.get(site); vc != nil && vc.OnceBlocked() {
+			ss.hbhLock.Lock()
+			ss.hasBlockedHost[host2Domain(site)] = true
+			ss.hbhLock.Unlock()
+		}
+	}
+	return
+}
+
+func (ss *SiteStat) export(w io.Writer) error {
+	b, err := json.MarshalIndent(ss.learnedStat(), "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func decodeSiteStat(b []byte) (*SiteStat, error) {
+	other := newSiteStat()
+	if err := json.Unmarshal(b, other); err != nil {
+		return nil, fmt.Errorf("decoding site stat: %v", err)
+	}
+	return other, nil
+}
+
+// peerStatURL returns URL for stat of peer cow given its self URL.
+func peerStatURL(peer string) string {
+	if i := strings.Index(peer, "://"); i != -1 && !strings.Contains(peer[i+3:], "/") {
+		return peer + "/stat"
+	}
+	return peer
+}
+
+// fetchSiteStat loads site stat from file, or peer cow if src is URL.
+func fetchSiteStat(src string) (*SiteStat, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			return nil, err
+		}
+		return decodeSiteStat(b)
+	}
+	// Connect to peer directly, not through proxy set in environment.
+	client := &nethttp.Client{Timeout: statPeerTimeout, Transport: &nethttp.Transport{}}
+	resp, err := client.Get(peerStatURL(src))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, fmt.Errorf("get stat from %s: %s", src, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSiteStat(b)
+}
+
+// sendStat serves learned site stat to peer cow.
+func sendStat(c *clientConn) error {
+	b, err := json.Marshal(siteStat.learnedStat())
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c, "HTTP/1.1 200 OK\r\n"+
+		"Connection: close\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Content-Length: %d\r\n\r\n%s", len(b), b)
+	return err
+}
+
+func pullPeerStat() {
+	for {
+		time.Sleep(config.StatPeerInterval)
+		for _, peer := range config.StatPeer {
+			other, err := fetchSiteStat(peer)
+			if err != nil {
+				errl.Println("pull stat from peer:", err)
+				continue
+			}
+			added, updated := siteStat.merge(other)
+			info.Printf("merged stat from %s, %d added, %d updated\n", peer, added, updated)
+		}
+	}
+}
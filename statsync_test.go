@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMergeVisitCnt(t *testing.T) {
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+
+	vc := newVisitCntWithTime(10, 0, yesterday)
+	if !mergeVisitCnt(vc, newVisitCntWithTime(0, 6, now)) || vc.Direct != 0 || vc.Blocked != 6 {
+		t.Error("more recent visit count should win")
+	}
+	if mergeVisitCnt(vc, newVisitCntWithTime(20, 0, yesterday)) || vc.Blocked != 6 {
+		t.Error("older visit count should not change")
+	}
+	if !mergeVisitCnt(vc, newVisitCntWithTime(3, 2, now)) || vc.Direct != 3 || vc.Blocked != 6 {
+		t.Error("larger counts should be taken for the same day")
+	}
+}
+
+func TestSiteStatMerge(t *testing.T) {
+	ss := newSiteStat()
+	ss.loadList([]string{"user.com"}, userCnt, 0)
+	ss.Vcnt["local.com"] = newVisitCnt(5, 0)
+
+	other := newSiteStat()
+	other.Vcnt["new.com"] = newVisitCnt(0, 8)
+	other.Vcnt["local.com"] = newVisitCnt(9, 0)
+	other.Vcnt["user.com"] = newVisitCnt(0, 8)
+	other.Vcnt["www.user.com"] = newVisitCnt(0, 8)
+	other.Vcnt["stale.com"] = newVisitCntWithTime(0, 8, time.Now().Add(-2*siteStaleThreshold))
+
+	// Export and decode as done when merging from file or peer.
+	var buf bytes.Buffer
+	if err := other.export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSiteStat(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Vcnt) != 4 {
+		t.Errorf("export should not include stale site, got %d sites\n", len(decoded.Vcnt))
+	}
+
+	added, updated := ss.merge(decoded)
+	if added != 2 || updated != 1 {
+		t.Errorf("should add 2 and update 1 site, got %d %d\n", added, updated)
+	}
+	if vc := ss.get("new.com"); vc == nil || vc.Blocked != 8 {
+		t.Error("new site should be added")
+	}
+	if !ss.hasBlockedHost["new.com"] {
+		t.Error("domain of merged blocked site should be marked as has blocked host")
+	}
+	if vc := ss.get("local.com"); vc.Direct != 9 {
+		t.Error("larger count on the same day should be merged")
+	}
+	if !ss.get("user.com").AlwaysDirect() || ss.hasBlockedHost["user.com"] {
+		t.Error("user specified site should not be changed")
+	}
+	if ss.get("www.user.com") != nil {
+		t.Error("site covered by user specified domain should be filtered")
+	}
+}
+
+func TestFetchSiteStat(t *testing.T) {
+	saved := siteStat
+	defer func() { siteStat = saved }()
+	siteStat = newSiteStat()
+	siteStat.Vcnt["peer.com"] = newVisitCnt(0, 7)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	reqLine := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		reqLine <- line
+		sendStat(newClientConn(conn, newHttpProxy("127.0.0.1:7777", "")))
+	}()
+
+	other, err := fetchSiteStat("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal("fetch stat from peer:", err)
+	}
+	if line := <-reqLine; line != "GET /stat HTTP/1.1\r\n" {
+		t.Errorf("should request /stat, got %q\n", line)
+	}
+	if vc := other.Vcnt["peer.com"]; vc == nil || vc.Blocked != 7 {
+		t.Error("stat from peer should contain peer.com")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "cow-statsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fpath := path.Join(tmpDir, "stat")
+	ioutil.WriteFile(fpath, []byte(`{"update":"2026-01-01","site_info":{"file.com":{"direct":3,"block":0,"recent":"2026-01-01"}}}`), 0644)
+	if other, err = fetchSiteStat(fpath); err != nil || other.Vcnt["file.com"] == nil {
+		t.Error("load stat from file failed:", err)
+	}
+}
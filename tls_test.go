@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// genTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir. Returns file path of the certificate and the key.
+func genTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cow test"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestLoadListenTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := genTestCert(t, dir)
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.TLSCertFile = certFile
+	config.TLSKeyFile = keyFile
+	tc := loadListenTLSConfig()
+	if len(tc.Certificates) != 1 {
+		t.Error("certificate not loaded")
+	}
+	if tc.ClientAuth != tls.NoClientCert {
+		t.Error("should not request client certificate without tlsClientCAFile")
+	}
+
+	config.TLSClientCAFile = certFile
+	tc = loadListenTLSConfig()
+	if tc.ClientCAs == nil {
+		t.Error("client CA not loaded")
+	}
+	if tc.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("client certificate should be required without other authentication")
+	}
+
+	config.UserPasswd = "foo:bar"
+	tc = loadListenTLSConfig()
+	if tc.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Error("client certificate should be optional with userPasswd")
+	}
+
+	if _, err := loadCertPool(keyFile); err == nil {
+		t.Error("load cert pool from key file should fail")
+	}
+}
+
+func TestHttpsParentConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cow-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := genTestCert(t, dir)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// echo back the request line
+				b := make([]byte, 64)
+				n, _ := c.Read(b)
+				c.Write(b[:n])
+				c.Close()
+			}()
+		}
+	}()
+
+	url := &URL{HostPort: "example.com:80"}
+
+	hp := newHttpParent(ln.Addr().String())
+	if err := hp.initTLS("", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hp.connect(url); err == nil {
+		t.Error("should not trust self-signed certificate")
+	}
+
+	hp = newHttpParent(ln.Addr().String())
+	if err := hp.initTLS("localhost", certFile, false); err != nil {
+		t.Fatal(err)
+	}
+	c, err := hp.connect(url)
+	if err != nil {
+		t.Fatal("connect https parent:", err)
+	}
+	defer c.Close()
+	if _, ok := c.(httpConn); !ok {
+		t.Error("https parent should return httpConn")
+	}
+	const req = "GET http://example.com/ HTTP/1.1\r\n"
+	c.Write([]byte(req))
+	b := make([]byte, 64)
+	n, _ := c.Read(b)
+	if string(b[:n]) != req {
+		t.Errorf("data not sent over TLS, got %q\n", b[:n])
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
@@ -228,6 +230,19 @@ func isDirExists(path string) error {
 	return nil
 }
 
+// loadCertPool loads PEM encoded certificates in file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
 func getUserHomeDir() string {
 	home := os.Getenv("HOME")
 	if home == "" {